@@ -1,37 +1,155 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"math"
+	"math/big"
+	"strconv"
+	"strings"
 
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
 )
 
+// AlgoAssetID is the 'asset id' used to mean native ALGO rather than an ASA
+const AlgoAssetID = 0
+
+// algoAssetParams are the pseudo asset params for ALGO so it can be treated like any other asset
+var algoAssetParams = models.AssetParams{
+	Decimals: 6,
+	Name:     "Algo",
+	UnitName: "ALGO",
+}
+
+// Amount is a decimal amount in display units (ie: 1.5 ALGO), kept exactly as specified so it can be converted to
+// base units without any floating point loss.  In json, it may be specified as a number or as a string.
+type Amount struct {
+	value *big.Rat
+}
+
+// ParseAmount parses a (non-negative) decimal amount - ie: "1.5"
+func ParseAmount(str string) (Amount, error) {
+	value, ok := new(big.Rat).SetString(strings.TrimSpace(str))
+	if !ok {
+		return Amount{}, fmt.Errorf("invalid amount:%s", str)
+	}
+	if value.Sign() < 0 {
+		return Amount{}, fmt.Errorf("amount:%s can't be negative", str)
+	}
+	return Amount{value: value}, nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	// numbers are taken as their exact json text, not converted to float
+	parsed, err := ParseAmount(string(bytes.Trim(data, `"`)))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a Amount) String() string {
+	if a.value == nil {
+		return "0"
+	}
+	return strings.TrimRight(strings.TrimRight(a.value.FloatString(20), "0"), ".")
+}
+
+func (a Amount) IsZero() bool {
+	return a.value == nil || a.value.Sign() == 0
+}
+
+// Add returns the sum of the two amounts
+func (a Amount) Add(other Amount) Amount {
+	sum := new(big.Rat)
+	if a.value != nil {
+		sum.Add(sum, a.value)
+	}
+	if other.value != nil {
+		sum.Add(sum, other.value)
+	}
+	return Amount{value: sum}
+}
+
+// BaseUnits converts the amount to base units of an asset with the specified number of decimals.  ie: 1.5 ALGO
+// (6 decimals) is 1,500,000 microAlgo.  Amounts having more precision than the decimals allow are rejected rather
+// than silently truncated.
+func (a Amount) BaseUnits(decimals uint64) (uint64, error) {
+	if a.value == nil {
+		return 0, nil
+	}
+	scaled := new(big.Rat).Mul(a.value, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), new(big.Int).SetUint64(decimals), nil)))
+	if !scaled.IsInt() {
+		return 0, fmt.Errorf("amount:%s has more precision than the %d decimals allowed", a, decimals)
+	}
+	if !scaled.Num().IsUint64() {
+		return 0, fmt.Errorf("amount:%s is too large", a)
+	}
+	return scaled.Num().Uint64(), nil
+}
+
 type SendAsset struct {
-	AssetID          uint64
-	AssetParams      models.AssetParams
-	ExistingBalance  uint64
-	AmountToSend     float64
+	AssetID         uint64
+	AssetParams     models.AssetParams
+	ExistingBalance uint64
+	// in base units - the exact value of the configured amount
+	AmountToSend     uint64
 	IsAmountPerRecip bool
 	Note             string
 }
 
+// NewSendAsset returns a SendAsset for the given asset configuration - validating the configured amount is
+// possible to send given the asset's decimals.
+func NewSendAsset(choice AssetChoice, params models.AssetParams, existingBalance uint64) (*SendAsset, error) {
+	baseUnits, err := choice.Amount.BaseUnits(params.Decimals)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount for ASA:%d (%s): %w", choice.ASA, params.UnitName, err)
+	}
+	return &SendAsset{
+		AssetID:          choice.ASA,
+		AssetParams:      params,
+		ExistingBalance:  existingBalance,
+		AmountToSend:     baseUnits,
+		IsAmountPerRecip: choice.IsPerRecip,
+		Note:             choice.Note,
+	}, nil
+}
+
 // write String method for SendAsset
 func (a *SendAsset) String() string {
-	return fmt.Sprintf("AssetID: %d (%s), ExistingBalance: %s, AmountToSend: %f, IsAmountPerRecip: %t, Note:%s",
+	return fmt.Sprintf("AssetID: %d (%s), ExistingBalance: %s, AmountToSend: %s, IsAmountPerRecip: %t, Note:%s",
 		a.AssetID,
 		a.AssetParams.UnitName,
 		a.formattedAmount(a.ExistingBalance),
-		a.AmountToSend,
+		a.formattedAmount(a.AmountToSend),
 		a.IsAmountPerRecip,
 		a.Note)
 }
 
+// IsAlgo returns true if this is a send of native ALGO (payment transactions) instead of an ASA
+func (s *SendAsset) IsAlgo() bool {
+	return s.AssetID == AlgoAssetID
+}
+
+// formattedAmount returns the base unit amount in display units, ie: 1500000 microAlgo is 1.500000
 func (s *SendAsset) formattedAmount(amount uint64) string {
-	return fmt.Sprintf("%.*f", s.AssetParams.Decimals, float64(amount)/math.Pow10(int(s.AssetParams.Decimals)))
+	decimals := int(s.AssetParams.Decimals)
+	if decimals == 0 {
+		return strconv.FormatUint(amount, 10)
+	}
+	digits := fmt.Sprintf("%0*d", decimals+1, amount)
+	return digits[:len(digits)-decimals] + "." + digits[len(digits)-decimals:]
 }
 
-func (s *SendAsset) amountInBaseUnits(amount float64) uint64 {
-	// ie: 1 (algo) becomes 1 million microAlgo.
-	return uint64(amount * math.Pow10(int(s.AssetParams.Decimals)))
+func (s *SendAsset) amountInBaseUnits(amount Amount) (uint64, error) {
+	baseUnits, err := amount.BaseUnits(s.AssetParams.Decimals)
+	if err != nil {
+		return 0, fmt.Errorf("asset %d (%s): %w", s.AssetID, s.AssetParams.UnitName, err)
+	}
+	return baseUnits, nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAmountBaseUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   string
+		decimals uint64
+		want     uint64
+		wantErr  string
+	}{
+		{name: "whole", amount: "3", decimals: 0, want: 3},
+		{name: "fraction", amount: "1.5", decimals: 6, want: 1_500_000},
+		{name: "full precision", amount: "0.000001", decimals: 6, want: 1},
+		{name: "trailing zeros", amount: "2.500000000", decimals: 2, want: 250},
+		{name: "zero", amount: "0", decimals: 6, want: 0},
+		{name: "max uint64", amount: "18446744073709551615", decimals: 0, want: 18446744073709551615},
+		{name: "max uint64 with decimals", amount: "18446744073.709551615", decimals: 9, want: 18446744073709551615},
+		{name: "over precision", amount: "1.0000001", decimals: 6, wantErr: "more precision"},
+		{name: "over precision no decimals", amount: "0.5", decimals: 0, wantErr: "more precision"},
+		{name: "overflow", amount: "18446744073709551616", decimals: 0, wantErr: "too large"},
+		{name: "overflow after scaling", amount: "18446744073710", decimals: 6, wantErr: "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, err := ParseAmount(tt.amount)
+			if err != nil {
+				t.Fatalf("ParseAmount(%s): %v", tt.amount, err)
+			}
+			got, err := amount.BaseUnits(tt.decimals)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("BaseUnits(%d) error = %v, want %q", tt.decimals, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BaseUnits(%d): %v", tt.decimals, err)
+			}
+			if got != tt.want {
+				t.Errorf("BaseUnits(%d) = %d, want %d", tt.decimals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAmountInvalid(t *testing.T) {
+	for _, str := range []string{"", "abc", "-1", "1.2.3"} {
+		if _, err := ParseAmount(str); err == nil {
+			t.Errorf("ParseAmount(%q) succeeded, want error", str)
+		}
+	}
+}
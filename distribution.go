@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/antihax/optional"
+	"github.com/mailgun/holster/v4/syncutil"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+	nfdapi "github.com/TxnLab/batch-asset-send/lib/nfdapi/swagger"
+)
+
+// applyDistributionWeights sets the weight of each recipient for the holding and segment count distribution
+// strategies.  Weights for the csv column strategy are set when the csv file is read, and equal needs none.
+func applyDistributionWeights(config *BatchSendConfig, recipients []*Recipient) error {
+	switch config.Distribution.Strategy {
+	case "", DistributeEqual:
+		return nil
+	case DistributeByCsvColumn:
+		// weights were set from the csv file itself
+		if config.Destination.CsvFile == "" {
+			return errors.New("distribution by csv column requires a csvFile destination")
+		}
+		return nil
+	case DistributeByHolding:
+		if config.Distribution.HoldingASA == 0 {
+			return errors.New("distribution byHolding requires a holdingAsa")
+		}
+		return applyHoldingWeights(config.Distribution.HoldingASA, recipients)
+	case DistributeBySegmentCount:
+		return applySegmentCountWeights(recipients)
+	default:
+		return fmt.Errorf("unknown distribution strategy:%s", config.Distribution.Strategy)
+	}
+}
+
+// applyHoldingWeights weights each recipient by the amount (in base units) of the reference ASA its owner holds.
+func applyHoldingWeights(assetID uint64, recipients []*Recipient) error {
+	var (
+		fanOut   = syncutil.NewFanOut(maxSimultaneousSends)
+		mu       sync.Mutex
+		holdings = map[string]uint64{}
+	)
+	for _, recipient := range recipients {
+		holdings[recipient.OwnerAccount] = 0
+	}
+	misc.Infof(logger, "..fetching holdings of ASA:%d for %d accounts", assetID, len(holdings))
+	for account := range holdings {
+		fanOut.Run(func(val any) error {
+			account := val.(string)
+			var amount uint64
+			err := retryAlgoCalls(func() error {
+				info, err := algoClient.AccountAssetInformation(account, assetID).Do(ctx)
+				if err != nil {
+					return err
+				}
+				amount = info.AssetHolding.Amount
+				return nil
+			})
+			if err != nil && !isAlgoNotFound(err) {
+				return fmt.Errorf("error fetching holding of ASA:%d for account:%s, err:%w", assetID, account, err)
+			}
+			mu.Lock()
+			holdings[account] = amount
+			mu.Unlock()
+			return nil
+		}, account)
+	}
+	if errs := fanOut.Wait(); len(errs) > 0 {
+		return errs[0]
+	}
+	for _, recipient := range recipients {
+		recipient.Weight = float64(holdings[recipient.OwnerAccount])
+	}
+	return nil
+}
+
+// applySegmentCountWeights weights each recipient by the number of (owned) segments of its NFD.  Only roots
+// have segments so everything else has no weight.
+func applySegmentCountWeights(recipients []*Recipient) error {
+	var (
+		fanSize = nfdThrottle.maxAtOnce // every fetch is an NFD API call
+		fanOut  = syncutil.NewFanOut(fanSize)
+	)
+	misc.Infof(logger, "..fetching segment counts for %d recipients", len(recipients))
+	for _, recipient := range recipients {
+		if recipient.AppID == 0 {
+			continue
+		}
+		fanOut.Run(func(val any) error {
+			recipient := val.(*Recipient)
+			var (
+				records nfdapi.NfdV2SearchRecords
+				err     error
+			)
+			err = retryNfdApiCalls(func() error {
+				records, _, err = api.NfdApi.NfdSearchV2(ctx, &nfdapi.NfdApiNfdSearchV2Opts{
+					ParentAppID: optional.NewInt64(recipient.AppID),
+					State:       optional.NewInterface("owned"),
+					View:        optional.NewString("tiny"),
+					Limit:       optional.NewInt64(1),
+				})
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error fetching segment count of %s, err:%w", recipient.NfdName, err)
+			}
+			// each recipient is only touched by its own goroutine
+			recipient.Weight = float64(records.Total)
+			return nil
+		}, recipient)
+	}
+	if errs := fanOut.Wait(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// apportion splits total (in base units) across the weights proportionally, giving whole base units only.
+// Each share is first rounded down, then the leftover base units (always fewer than the number of weights) are
+// handed out one each to the shares with the largest fractional remainder - ties going to the earliest - so
+// the shares always add up to exactly the total.
+func apportion(total uint64, weights []float64) ([]uint64, error) {
+	var (
+		shares      = make([]uint64, len(weights))
+		remainders  = make([]*big.Rat, len(weights))
+		totalWeight = new(big.Rat)
+		bigTotal    = new(big.Rat).SetInt(new(big.Int).SetUint64(total))
+		allocated   uint64
+	)
+	for _, weight := range weights {
+		bigWeight := new(big.Rat).SetFloat64(weight)
+		if bigWeight == nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight:%v to distribute by", weight)
+		}
+		totalWeight.Add(totalWeight, bigWeight)
+	}
+	if totalWeight.Sign() == 0 {
+		if total == 0 {
+			return shares, nil
+		}
+		return nil, errors.New("no recipient has any weight to distribute by")
+	}
+	for i, weight := range weights {
+		share := new(big.Rat).SetFloat64(weight)
+		share.Mul(share, bigTotal)
+		share.Quo(share, totalWeight)
+		whole := new(big.Int).Quo(share.Num(), share.Denom())
+		shares[i] = whole.Uint64()
+		allocated += shares[i]
+		remainders[i] = share.Sub(share, new(big.Rat).SetInt(whole))
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]].Cmp(remainders[order[j]]) > 0
+	})
+	for i := uint64(0); i < total-allocated; i++ {
+		shares[order[i]]++
+	}
+	return shares, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestApportion(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   uint64
+		weights []float64
+		want    []uint64
+		wantErr bool
+	}{
+		{name: "even split", total: 9, weights: []float64{1, 1, 1}, want: []uint64{3, 3, 3}},
+		{name: "remainder to earliest on ties", total: 10, weights: []float64{1, 1, 1}, want: []uint64{4, 3, 3}},
+		{name: "remainder split on ties", total: 11, weights: []float64{1, 1, 1}, want: []uint64{4, 4, 3}},
+		{name: "remainder to largest fraction", total: 10, weights: []float64{1, 2, 4}, want: []uint64{1, 3, 6}},
+		{name: "weighted exact", total: 100, weights: []float64{1, 3}, want: []uint64{25, 75}},
+		{name: "zero weight gets nothing", total: 5, weights: []float64{0, 1, 1}, want: []uint64{0, 3, 2}},
+		{name: "fractional weights", total: 3, weights: []float64{0.5, 0.25, 0.25}, want: []uint64{1, 1, 1}},
+		{name: "large total", total: math.MaxUint64, weights: []float64{1, 1}, want: []uint64{math.MaxUint64/2 + 1, math.MaxUint64 / 2}},
+		{name: "less than one unit each", total: 2, weights: []float64{1, 1, 1, 1}, want: []uint64{1, 1, 0, 0}},
+		{name: "zero total", total: 0, weights: []float64{1, 2}, want: []uint64{0, 0}},
+		// every recipient has its own amount - nothing left to share, and no one to share it with
+		{name: "all overridden", total: 0, weights: nil, want: []uint64{}},
+		{name: "zero total, no weight", total: 0, weights: []float64{0, 0}, want: []uint64{0, 0}},
+		{name: "no weight", total: 10, weights: []float64{0, 0}, wantErr: true},
+		{name: "nothing to share with", total: 10, weights: nil, wantErr: true},
+		{name: "negative weight", total: 10, weights: []float64{1, -1}, wantErr: true},
+		{name: "NaN weight", total: 10, weights: []float64{1, math.NaN()}, wantErr: true},
+		{name: "infinite weight", total: 10, weights: []float64{1, math.Inf(1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apportion(tt.total, tt.weights)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("apportion(%d, %v) = %v, want error", tt.total, tt.weights, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apportion(%d, %v): %v", tt.total, tt.weights, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("apportion(%d, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+			var sum uint64
+			for _, share := range got {
+				sum += share
+			}
+			if sum != tt.total {
+				t.Errorf("apportion(%d, %v) shares add up to %d", tt.total, tt.weights, sum)
+			}
+		})
+	}
+}
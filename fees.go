@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+const (
+	// estimatedTxnSize is the (generous) size in bytes of a transfer with a note and lease - for estimating its fee
+	// when the fee is per byte
+	estimatedTxnSize = 300
+	// how long to wait before checking again if fees are above the cap
+	feeCapPauseTime = 15 * time.Second
+)
+
+// validateFeeChoice makes sure the fee configuration is usable
+func validateFeeChoice(fees FeeChoice) error {
+	switch fees.Policy {
+	case "", FeePolicyMin, FeePolicySuggested:
+		return nil
+	default:
+		return fmt.Errorf("unknown fee policy:%s, must be min or suggested", fees.Policy)
+	}
+}
+
+// estimatedTxnFee returns the fee a transfer will pay with the given params
+func estimatedTxnFee(params types.SuggestedParams) uint64 {
+	if params.FlatFee {
+		return uint64(params.Fee)
+	}
+	return max(uint64(params.Fee)*estimatedTxnSize, params.MinFee)
+}
+
+// sendParams returns the params to build sends with, according to the fee policy.  If the fee is above the
+// configured cap, it waits (pausing the sends) until it drops back below it - or until stopping is closed.
+func sendParams(stopping <-chan struct{}) types.SuggestedParams {
+	var paused bool
+	for {
+		params := algo.SuggestedParamsForFee(ctx, logger, algoClient, sendConfig.Fees.Policy == FeePolicySuggested)
+		fee := estimatedTxnFee(params)
+		if sendConfig.Fees.MaxFeePerTxn == 0 || fee <= sendConfig.Fees.MaxFeePerTxn {
+			if paused {
+				misc.Infof(logger, "Fees back down to %s ALGO per txn - resuming", algo.FormattedAlgoAmount(fee))
+			}
+			return params
+		}
+		if !paused {
+			misc.Infof(logger, "Fees of %s ALGO per txn are above the max of %s - pausing until they drop",
+				algo.FormattedAlgoAmount(fee), algo.FormattedAlgoAmount(sendConfig.Fees.MaxFeePerTxn))
+			paused = true
+		}
+		select {
+		case <-time.After(feeCapPauseTime):
+		case <-stopping:
+			return params
+		}
+	}
+}
+
+// expectedTxnFee returns the fee per txn to expect (and budget for) across the whole run - the cap if there is one,
+// as fees may rise to it, otherwise the current fee.
+func expectedTxnFee() uint64 {
+	if sendConfig.Fees.Policy == FeePolicySuggested && sendConfig.Fees.MaxFeePerTxn != 0 {
+		return sendConfig.Fees.MaxFeePerTxn
+	}
+	return estimatedTxnFee(algo.SuggestedParamsForFee(ctx, logger, algoClient, sendConfig.Fees.Policy == FeePolicySuggested))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+// maxGroupSize is the most transactions the protocol allows in one atomic group
+const maxGroupSize = 16
+
+// sendGroupToRecipients sends a batch of direct (non-vault) sends as a single atomic group - one submit and one
+// confirmation wait for the whole batch rather than one of each per recipient.  The group either confirms or fails
+// as a whole, so if the node rejects it (ie: one recipient isn't opted-in) each send is retried on its own so the
+// rest still go out.  A group that was submitted but couldn't be confirmed is NOT retried as it may have landed.  Once
+// stopping is closed, sends that would be retried are left unsent instead.
+func sendGroupToRecipients(sender string, group []SendRequest, journal *SendJournal, stopping <-chan struct{}) []*RecipientTransaction {
+	var (
+		txns    []types.Transaction
+		signers []algo.TxnSigner
+		results = make([]*RecipientTransaction, len(group))
+	)
+	for i := range group {
+		sendReq := &group[i]
+		misc.Infof(logger, "  %s: %s (group of %d)", sendReq.recipient.DepositAccount, sendReq.recipient.NfdName, len(group))
+		results[i] = &RecipientTransaction{
+			sendAsset:       &sendReq.asset,
+			baseUnitsToSend: sendReq.amount,
+			recip:           &sendReq.recipient,
+		}
+		txn, err := makeDirectSendTxn(
+			sender,
+			sendReq.recipient.DepositAccount,
+			sendReq.asset.AssetID,
+			sendReq.amount,
+			sendReq.txnNote(),
+			sendLease(runID, &sendReq.recipient, sendReq.asset.AssetID),
+			sendReq.params,
+		)
+		if err != nil {
+			return sendIndividually(sender, group, journal, stopping, err)
+		}
+		txns = append(txns, txn)
+		results[i].fee = uint64(txn.Fee)
+		signers = algo.SignWithAccount(signers, signer, sender)
+	}
+	signedBytes, txids, err := algo.SignGroupTransactions(ctx, txns, signers)
+	if err != nil {
+		return sendIndividually(sender, group, journal, stopping, err)
+	}
+	// sends are queued in order so have differing params - the group can be confirmed until the last of them expires
+	firstValid, lastValid, err := txnsValidity(signedBytes)
+	if err != nil {
+		return sendIndividually(sender, group, journal, stopping, err)
+	}
+
+	// Journal them all before sending - if we die after sending, a resume will check if they made it
+	for i := range group {
+		journal.recordSubmitted(&group[i], txids[i], lastValid)
+	}
+	if _, err = sendTxns(signedBytes); err != nil {
+		return sendIndividually(sender, group, journal, stopping, err)
+	}
+	pendResponse, err := waitForTxn(txids[0], lastValid-firstValid)
+	if err != nil && isExpired(err) {
+		// the group expired unconfirmed - as long as it didn't land, each send can be tried again on its own
+		landedRound, checkErr := expiredSendLanded(txids[0], lastValid)
+		if checkErr == nil && landedRound == 0 {
+			params := sendParams(stopping)
+			for i := range group {
+				group[i].params = params
+			}
+			return sendIndividually(sender, group, journal, stopping, err)
+		}
+		if checkErr == nil {
+			pendResponse.ConfirmedRound, err = landedRound, nil
+		}
+	}
+	for i, result := range results {
+		if err != nil {
+			result.Error = fmt.Errorf("waiting for group txn: %w", err)
+			result.submittedTxID = txids[i]
+			continue
+		}
+		// every txn of an atomic group confirms in the same round
+		result.Success.round = pendResponse.ConfirmedRound
+		result.Success.txid = txids[i]
+	}
+	return results
+}
+
+// sendIndividually falls back to sending each member of a group that couldn't be sent on its own - or if stopping,
+// leaves them all unsent (the group didn't land, so they surely weren't sent).
+func sendIndividually(sender string, group []SendRequest, journal *SendJournal, stopping <-chan struct{}, groupErr error) []*RecipientTransaction {
+	results := make([]*RecipientTransaction, len(group))
+	if isStopping(stopping) {
+		misc.Infof(logger, "Group of %d sends failed, stopping so not sending individually: %v", len(group), groupErr)
+		for i := range group {
+			results[i] = &RecipientTransaction{
+				sendAsset:       &group[i].asset,
+				baseUnitsToSend: group[i].amount,
+				recip:           &group[i].recipient,
+				unsent:          true,
+			}
+		}
+		return results
+	}
+	misc.Infof(logger, "Group of %d sends failed, sending individually: %v", len(group), groupErr)
+	for i := range group {
+		results[i] = sendAssetToRecipient(sender, &group[i], journal, false, stopping)
+	}
+	return results
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/holster/v4/syncutil"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+	nfdapi "github.com/TxnLab/batch-asset-send/lib/nfdapi/swagger"
+)
+
+// Modes of the holdsAssets filter
+const (
+	HoldsAny = "any"
+	HoldsAll = "all"
+)
+
+// HoldsAssetsChoice limits recipients to NFDs whose owner holds (any or all of) the specified assets
+type HoldsAssetsChoice struct {
+	Assets []HeldAsset `json:"assets"`
+	// any (default) - holding at least one of the assets is enough, all - every asset has to be held
+	Mode string `json:"mode,omitempty"`
+	// Whether the (verified) caAlgo accounts of the NFD count as well as its owner - their holdings are added together
+	IncludeCaAlgo bool `json:"includeCaAlgo,omitempty"`
+}
+
+// HeldAsset is an asset (0 for ALGO) that has to be held, and the minimum amount of it in display units - any
+// non-zero amount if not specified.
+type HeldAsset struct {
+	ASA        uint64 `json:"asa"`
+	MinBalance Amount `json:"minBalance"`
+}
+
+func (hc HoldsAssetsChoice) String() string {
+	var assets []string
+	for _, held := range hc.Assets {
+		if held.MinBalance.IsZero() {
+			assets = append(assets, fmt.Sprintf("%d", held.ASA))
+		} else {
+			assets = append(assets, fmt.Sprintf("%d>=%s", held.ASA, held.MinBalance))
+		}
+	}
+	mode := hc.Mode
+	if mode == "" {
+		mode = HoldsAny
+	}
+	str := fmt.Sprintf("%s of [%s]", mode, strings.Join(assets, ", "))
+	if hc.IncludeCaAlgo {
+		str += " (incl. caAlgo accounts)"
+	}
+	return str
+}
+
+// filterByHoldings returns only the NFDs holding the assets of the holdsAssets filter - checking the owner account
+// (and the caAlgo accounts if specified) of each.
+func filterByHoldings(choice *HoldsAssetsChoice, records []*nfdapi.NfdRecord) ([]*nfdapi.NfdRecord, error) {
+	if len(choice.Assets) == 0 {
+		return nil, errors.New("holdsAssets requires at least one asset")
+	}
+	if choice.Mode != "" && choice.Mode != HoldsAny && choice.Mode != HoldsAll {
+		return nil, fmt.Errorf("unknown holdsAssets mode:%s, must be any or all", choice.Mode)
+	}
+	// minimums in base units of each asset
+	minBalances := make([]uint64, len(choice.Assets))
+	for i, held := range choice.Assets {
+		decimals := algoAssetParams.Decimals
+		if held.ASA != AlgoAssetID {
+			assetInfo, err := algoClient.GetAssetByID(held.ASA).Do(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching holdsAssets asset:%d, err:%w", held.ASA, err)
+			}
+			decimals = assetInfo.Params.Decimals
+		}
+		minBalance, err := held.MinBalance.BaseUnits(decimals)
+		if err != nil {
+			return nil, fmt.Errorf("holdsAssets minBalance of asset:%d, err:%w", held.ASA, err)
+		}
+		minBalances[i] = max(minBalance, 1)
+	}
+
+	holdings, err := fetchHoldings(choice, records)
+	if err != nil {
+		return nil, err
+	}
+	filteredRecords := make([]*nfdapi.NfdRecord, 0, len(records))
+	for _, nfd := range records {
+		var numHeld int
+		for i, held := range choice.Assets {
+			var total uint64
+			for _, account := range holderAccounts(choice, nfd) {
+				total += holdings[holdingKey{account, held.ASA}]
+			}
+			if total >= minBalances[i] {
+				numHeld++
+			}
+		}
+		if numHeld == len(choice.Assets) || (numHeld > 0 && choice.Mode != HoldsAll) {
+			filteredRecords = append(filteredRecords, nfd)
+		}
+	}
+	misc.Infof(logger, "..holdsAssets filter kept %d of %d NFDs", len(filteredRecords), len(records))
+	return filteredRecords, nil
+}
+
+type holdingKey struct {
+	account string
+	assetID uint64
+}
+
+// holderAccounts returns the (unique) accounts of the NFD whose holdings count
+func holderAccounts(choice *HoldsAssetsChoice, nfd *nfdapi.NfdRecord) []string {
+	accounts := []string{nfd.Owner}
+	if choice.IncludeCaAlgo {
+		for _, account := range nfd.CaAlgo {
+			if account != nfd.Owner {
+				accounts = append(accounts, account)
+			}
+		}
+	}
+	return accounts
+}
+
+// fetchHoldings looks up the amount (in base units) of each asset held by every account of the NFDs - concurrently,
+// through the algod throttle.  Accounts not opted-in to an asset hold none of it.
+func fetchHoldings(choice *HoldsAssetsChoice, records []*nfdapi.NfdRecord) (map[holdingKey]uint64, error) {
+	var (
+		fanOut   = syncutil.NewFanOut(maxSimultaneousSends)
+		mu       sync.Mutex
+		holdings = map[holdingKey]uint64{}
+	)
+	for _, nfd := range records {
+		for _, account := range holderAccounts(choice, nfd) {
+			for _, held := range choice.Assets {
+				holdings[holdingKey{account, held.ASA}] = 0
+			}
+		}
+	}
+	keys := make([]holdingKey, 0, len(holdings))
+	for key := range holdings {
+		keys = append(keys, key)
+	}
+	misc.Infof(logger, "..fetching %d asset holdings for the holdsAssets filter", len(keys))
+	for _, key := range keys {
+		fanOut.Run(func(val any) error {
+			key := val.(holdingKey)
+			var amount uint64
+			err := retryAlgoCalls(func() error {
+				if key.assetID == AlgoAssetID {
+					info, err := algo.GetBareAccount(ctx, algoClient, key.account)
+					amount = info.Amount
+					return err
+				}
+				info, err := algoClient.AccountAssetInformation(key.account, key.assetID).Do(ctx)
+				amount = info.AssetHolding.Amount
+				return err
+			})
+			if err != nil && !isAlgoNotFound(err) {
+				return fmt.Errorf("error fetching holding of ASA:%d for account:%s, err:%w", key.assetID, key.account, err)
+			}
+			mu.Lock()
+			holdings[key] = amount
+			mu.Unlock()
+			return nil
+		}, key)
+	}
+	if errs := fanOut.Wait(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return holdings, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// noteTagPrefix is the ARC-2 style prefix (<dapp>:<format>) used for machine-readable notes
+const noteTagPrefix = "batch-asset-send:j"
+
+// newRunID returns a new random ID identifying a run (and any resumptions of it).
+func newRunID() string {
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(idBytes[:])
+}
+
+// sendLease returns the lease for a send of an asset to a recipient within a run.  It's the same every time that
+// send is (re)built, so a second copy of a send can't be confirmed while the first is still valid - the protocol
+// rejects it.
+func sendLease(runID string, recipient *Recipient, assetID uint64) [32]byte {
+	return sha512.Sum512_256([]byte(fmt.Sprintf("%s/%s/%d", runID, recipient.Key(), assetID)))
+}
+
+// taggedNote returns the note for a send when machine-readable notes are enabled - identifying the run, recipient
+// and asset (plus the configured note) so sends can be found and matched up afterward.
+func taggedNote(runID string, recipient *Recipient, assetID uint64, note string) string {
+	tag, _ := json.Marshal(struct {
+		Run   string `json:"run"`
+		NFD   string `json:"nfd,omitempty"`
+		Asset uint64 `json:"asset"`
+		Note  string `json:"note,omitempty"`
+	}{runID, recipient.NfdName, assetID, note})
+	return noteTagPrefix + string(tag)
+}
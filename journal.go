@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+	"github.com/algorand/go-algorand-sdk/v2/transaction"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+// Journal states - a send moves from planned to submitted to confirmed (or failed)
+const (
+	JournalPlanned   = "planned"
+	JournalSubmitted = "submitted"
+	JournalConfirmed = "confirmed"
+	JournalFailed    = "failed"
+)
+
+// JournalEntry is a single line of the send journal - recording the current state of one send (recipient + asset).
+// The last entry for a given send is its current state.
+type JournalEntry struct {
+	RunID          string    `json:"run"`
+	Time           time.Time `json:"time"`
+	State          string    `json:"state"`
+	NfdName        string    `json:"nfd"`
+	OwnerAccount   string    `json:"owner"`
+	DepositAccount string    `json:"depositAccount"`
+	SendToVault    bool      `json:"sendToVault"`
+	AssetID        uint64    `json:"asset"`
+	Amount         uint64    `json:"amount"`
+	TxID           string    `json:"txid,omitempty"`
+	LastValid      uint64    `json:"lastValid,omitempty"`
+	Round          uint64    `json:"round,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+func (je *JournalEntry) key() string {
+	return journalKey(&Recipient{NfdName: je.NfdName, DepositAccount: je.DepositAccount}, je.AssetID)
+}
+
+func journalKey(recipient *Recipient, assetID uint64) string {
+	return fmt.Sprintf("%s/%d", recipient.Key(), assetID)
+}
+
+// SendJournal is an append-only (json lines) file recording the state of every send as it progresses, so an
+// interrupted run can be resumed without sending to anyone twice.  Each entry is synced to disk as it's written.
+type SendJournal struct {
+	// RunID of the run this journal is for - kept across resumptions
+	RunID    string
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+	latest   map[string]*JournalEntry
+	order    []string // keys in the order first seen
+}
+
+// CreateJournal creates a new journal file for a fresh run
+func CreateJournal(filename string, runID string) (*SendJournal, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating journal: %w", err)
+	}
+	return &SendJournal{RunID: runID, filename: filename, file: file, latest: map[string]*JournalEntry{}}, nil
+}
+
+// OpenJournal loads an existing journal (to resume from), and opens it for appending further entries.
+func OpenJournal(filename string) (*SendJournal, error) {
+	journal := &SendJournal{filename: filename, latest: map[string]*JournalEntry{}}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %w", err)
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a crash mid-write can only leave a partial last line
+			misc.Infof(logger, "ignoring unreadable journal line %d: %v", lineNum, err)
+			continue
+		}
+		if journal.RunID == "" {
+			journal.RunID = entry.RunID
+		}
+		journal.track(&entry)
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	journal.file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal for append: %w", err)
+	}
+	return journal, nil
+}
+
+func (j *SendJournal) track(entry *JournalEntry) {
+	key := entry.key()
+	prior, found := j.latest[key]
+	if !found {
+		j.order = append(j.order, key)
+	} else if entry.State == JournalFailed && entry.TxID == "" && prior.State == JournalSubmitted {
+		// keep the txid of a send that failed after it was submitted - it may still have landed
+		entry.TxID = prior.TxID
+		entry.LastValid = prior.LastValid
+	}
+	j.latest[key] = entry
+}
+
+// record appends the entry to the journal, syncing it to disk before returning.  A journal that can't be written
+// isn't safe to continue with, so failures are fatal.
+func (j *SendJournal) record(entry JournalEntry) {
+	if j == nil {
+		return
+	}
+	entry.RunID = j.RunID
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed encoding journal entry: %s", err))
+		os.Exit(1)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.file.Write(append(line, '\n')); err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed writing to journal %s: %s", j.filename, err))
+		os.Exit(1)
+	}
+	j.track(&entry)
+}
+
+func newJournalEntry(state string, asset *SendAsset, recipient *Recipient, amount uint64) JournalEntry {
+	return JournalEntry{
+		State:          state,
+		NfdName:        recipient.NfdName,
+		OwnerAccount:   recipient.OwnerAccount,
+		DepositAccount: recipient.DepositAccount,
+		SendToVault:    recipient.SendToVault,
+		AssetID:        asset.AssetID,
+		Amount:         amount,
+	}
+}
+
+// recordPlanned writes the full plan to the journal - done once, before any sends
+func (j *SendJournal) recordPlanned(plan []*PlannedSend) {
+	for _, send := range plan {
+		j.record(newJournalEntry(JournalPlanned, send.asset, send.recipient, send.amount))
+	}
+	if j != nil {
+		misc.Infof(logger, "Journaling %d planned sends to %s", len(plan), j.filename)
+	}
+}
+
+// recordSubmitted records the send as submitted, with the last round its txns are valid in (from the signed txns, see
+// txnsValidity)
+func (j *SendJournal) recordSubmitted(sendReq *SendRequest, txid string, lastValid uint64) {
+	entry := newJournalEntry(JournalSubmitted, &sendReq.asset, &sendReq.recipient, sendReq.amount)
+	entry.TxID = txid
+	entry.LastValid = lastValid
+	j.record(entry)
+}
+
+func (j *SendJournal) recordResult(result *RecipientTransaction) {
+	entry := newJournalEntry(JournalConfirmed, result.sendAsset, result.recip, result.baseUnitsToSend)
+	entry.TxID = result.txid()
+	entry.Round = result.Success.round
+	if result.Error != nil {
+		entry.State = JournalFailed
+		entry.Error = result.Error.Error()
+	}
+	j.record(entry)
+}
+
+// recordUnsent puts a send that was stopped before it could be (re)sent back to planned - it surely didn't land, so
+// a resume sends it.
+func (j *SendJournal) recordUnsent(result *RecipientTransaction) {
+	j.record(newJournalEntry(JournalPlanned, result.sendAsset, result.recip, result.baseUnitsToSend))
+}
+
+func (j *SendJournal) Close() {
+	if j != nil {
+		j.file.Close()
+	}
+}
+
+// reconcileSubmitted checks every send that was submitted but whose outcome wasn't recorded against the chain - those
+// left in the submitted state, and those that failed with a txid (ie: the confirmation wait failed).  Confirmed sends
+// are recorded as such, sends that surely didn't land (rejected, expired unconfirmed, or not found by the indexer)
+// go back to planned so they're retried.  Sends whose outcome can't be determined (ie: the node no longer knows of
+// the txn and there's no indexer) are returned so they can be reported - and are NOT retried, as they may well have
+// landed.
+func (j *SendJournal) reconcileSubmitted() []*JournalEntry {
+	var unknown []*JournalEntry
+	for _, key := range j.order {
+		entry := *j.latest[key]
+		if entry.State != JournalSubmitted && (entry.State != JournalFailed || entry.TxID == "") {
+			continue
+		}
+		confirmedRound, absent, err := checkSubmitted(&entry)
+		switch {
+		case err != nil:
+			misc.Infof(logger, "..unable to determine if %s to %s landed: %v", entry.TxID, entry.NfdName, err)
+			unknown = append(unknown, j.latest[key])
+			continue
+		case confirmedRound != 0:
+			entry.State = JournalConfirmed
+			entry.Round = confirmedRound
+			entry.Error = ""
+			misc.Infof(logger, "..%s to %s was confirmed in round %d", entry.TxID, entry.NfdName, confirmedRound)
+		default:
+			entry.State = JournalPlanned
+			entry.TxID = ""
+			entry.LastValid = 0
+			entry.Error = ""
+			misc.Infof(logger, "..%s to %s did not land (%s), will retry", j.latest[key].TxID, entry.NfdName, absent)
+		}
+		j.record(entry)
+	}
+	return unknown
+}
+
+// checkSubmitted determines whether a submitted send landed - waiting out its validity window if it's still in the
+// pool.  Returns the round it was confirmed in, or 0 and why it surely didn't land.  An error means its outcome
+// can't be determined.
+func checkSubmitted(entry *JournalEntry) (uint64, string, error) {
+	var (
+		pendingInfo models.PendingTransactionInfoResponse
+		err         error
+	)
+	lookup := func() error {
+		return retryAlgoCalls(func() error {
+			pendingInfo, _, err = algoClient.PendingTransactionInformation(entry.TxID).Do(ctx)
+			return err
+		})
+	}
+	err = lookup()
+	if err == nil && pendingInfo.PoolError == "" && pendingInfo.ConfirmedRound == 0 && entry.LastValid != 0 {
+		// still in the pool - wait out its validity window, then look again
+		var status models.NodeStatus
+		if err = retryAlgoCalls(func() error {
+			status, err = algoClient.Status().Do(ctx)
+			return err
+		}); err != nil {
+			return 0, "", err
+		}
+		if status.LastRound <= entry.LastValid {
+			// confirmed or not, it's looked up again below
+			_, _ = transaction.WaitForConfirmation(algoClient, entry.TxID, entry.LastValid-status.LastRound+1, ctx)
+		}
+		err = lookup()
+	}
+	switch {
+	case err == nil && pendingInfo.ConfirmedRound != 0:
+		return pendingInfo.ConfirmedRound, "", nil
+	case err == nil && pendingInfo.PoolError != "":
+		return 0, "rejected: " + pendingInfo.PoolError, nil
+	case err == nil && entry.LastValid != 0 && pastLastValid(entry.LastValid):
+		return 0, "expired unconfirmed", nil
+	case err == nil:
+		return 0, "", errors.New("still waiting to be confirmed")
+	case !isAlgoNotFound(err):
+		return 0, "", err
+	case indexerClient == nil:
+		return 0, "", errors.New("not known to the node (and no indexer configured to look up older txns)")
+	}
+	var txnResp models.TransactionResponse
+	err = retryAlgoCalls(func() error {
+		txnResp, err = indexerClient.LookupTransaction(entry.TxID).Do(ctx)
+		return err
+	})
+	if isAlgoNotFound(err) {
+		return 0, "not found on chain", nil
+	} else if err != nil {
+		return 0, "", fmt.Errorf("unable to look up txn in indexer: %w", err)
+	}
+	return txnResp.Transaction.ConfirmedRound, "", nil
+}
+
+// remainingPlan rebuilds the plan from the journal - skipping sends that are already confirmed or whose outcome
+// is unknown (still submitted, or failed with a txid, after reconcileSubmitted).  Recipients and amounts come from
+// the journal, so they match the original run exactly.
+func (j *SendJournal) remainingPlan(assets []*SendAsset) ([]*PlannedSend, error) {
+	var (
+		plan         []*PlannedSend
+		assetsByID   = map[uint64]*SendAsset{}
+		numConfirmed int
+	)
+	if len(j.order) == 0 || j.RunID == "" {
+		return nil, errors.New("journal has no sends (or run id) in it")
+	}
+	for _, asset := range assets {
+		assetsByID[asset.AssetID] = asset
+	}
+	for _, key := range j.order {
+		entry := j.latest[key]
+		switch entry.State {
+		case JournalConfirmed:
+			numConfirmed++
+			continue
+		case JournalSubmitted:
+			continue
+		case JournalFailed:
+			if entry.TxID != "" {
+				// may have landed - reported by reconcileSubmitted
+				continue
+			}
+		}
+		asset, found := assetsByID[entry.AssetID]
+		if !found {
+			return nil, fmt.Errorf("journal has send of asset %d which isn't available to send", entry.AssetID)
+		}
+		recipient := &Recipient{
+			NfdName:        entry.NfdName,
+			OwnerAccount:   entry.OwnerAccount,
+			DepositAccount: entry.DepositAccount,
+			SendToVault:    entry.SendToVault,
+		}
+		if sendConfig.Send.Nfts != nil {
+			recipient.NftAssetID = entry.AssetID
+		}
+		plan = append(plan, &PlannedSend{asset: asset, recipient: recipient, amount: entry.Amount})
+	}
+	misc.Infof(logger, "Journal %s: %d sends, %d already confirmed, %d remaining", j.filename, len(j.order), numConfirmed, len(plan))
+	return plan, nil
+}
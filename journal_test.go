@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/algod"
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/indexer"
+	"github.com/algorand/go-algorand-sdk/v2/encoding/msgpack"
+)
+
+const testRunID = "testrun1"
+
+// fakeChain answers the algod and indexer calls made checking whether sends landed
+type fakeChain struct {
+	lastRound uint64
+	// txid -> what the node's pool knows of it - missing txids are unknown to the node (404)
+	pending map[string]models.PendingTransactionInfoResponse
+	// txid -> the confirmed txn according to the indexer - missing txids aren't on chain (404)
+	indexed map[string]models.Transaction
+	// txids the indexer fails to look up
+	indexerErrors map[string]bool
+}
+
+// setupTestGlobals sets the globals sends depend on, with algod (and the indexer, if withIndexer) served by chain.
+// They're restored once the test is done.
+func setupTestGlobals(t *testing.T, chain *fakeChain, withIndexer bool) {
+	t.Helper()
+	var (
+		priorLogger   = logger
+		priorConfig   = sendConfig
+		priorAlgod    = algoClient
+		priorIndexer  = indexerClient
+		priorThrottle = algodThrottle
+	)
+	t.Cleanup(func() {
+		logger, sendConfig, algoClient, indexerClient, algodThrottle = priorLogger, priorConfig, priorAlgod, priorIndexer, priorThrottle
+	})
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	sendConfig = &BatchSendConfig{}
+	algodThrottle = newThrottle("algod", 0, 10)
+
+	algodServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/status":
+			json.NewEncoder(w).Encode(models.NodeStatus{LastRound: chain.lastRound})
+		case strings.HasPrefix(r.URL.Path, "/v2/transactions/pending/"):
+			info, found := chain.pending[strings.TrimPrefix(r.URL.Path, "/v2/transactions/pending/")]
+			if !found {
+				http.Error(w, `{"message":"txn not found"}`, http.StatusNotFound)
+				return
+			}
+			w.Write(msgpack.Encode(info))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(algodServer.Close)
+	var err error
+	if algoClient, err = algod.MakeClient(algodServer.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	indexerClient = nil
+	if !withIndexer {
+		return
+	}
+	indexerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		txid := strings.TrimPrefix(r.URL.Path, "/v2/transactions/")
+		txn, found := chain.indexed[txid]
+		switch {
+		case chain.indexerErrors[txid]:
+			http.Error(w, `{"message":"internal error"}`, http.StatusInternalServerError)
+		case !found:
+			http.Error(w, `{"message":"no transaction found"}`, http.StatusNotFound)
+		default:
+			txn.Id = txid
+			json.NewEncoder(w).Encode(models.TransactionResponse{CurrentRound: chain.lastRound, Transaction: txn})
+		}
+	}))
+	t.Cleanup(indexerServer.Close)
+	if indexerClient, err = indexer.MakeClient(indexerServer.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeJournalFixture writes the journal lines (json entries, with the run id filled in) to a file in a temp dir
+func writeJournalFixture(t *testing.T, lines ...string) string {
+	t.Helper()
+	var sb strings.Builder
+	for _, line := range lines {
+		if strings.HasPrefix(line, "{") {
+			line = `{"run":"` + testRunID + `",` + line[1:]
+		}
+		sb.WriteString(line + "\n")
+	}
+	filename := filepath.Join(t.TempDir(), "journal.jsonl")
+	if err := os.WriteFile(filename, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// planSummary describes each planned send as nfd/asset/amount - in plan order
+func planSummary(plan []*PlannedSend) []string {
+	var summary []string
+	for _, send := range plan {
+		summary = append(summary, fmt.Sprintf("%s/%d/%d", send.recipient.NfdName, send.asset.AssetID, send.amount))
+	}
+	return summary
+}
+
+var testAssets = []*SendAsset{{AssetID: 1000}, {AssetID: 2000}}
+
+func TestJournalTrack(t *testing.T) {
+	setupTestGlobals(t, &fakeChain{}, false)
+	filename := writeJournalFixture(t,
+		`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5}`,
+		`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+		`{"state":"submitted","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"txid":"TXA","lastValid":1100}`,
+		// the confirmation wait failed - the txid of the submitted send is kept
+		`{"state":"failed","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"error":"waiting for txn: timed out"}`,
+		// planned again (ie: by a resume) - still the same send, in the same place
+		`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+	)
+	journal, err := OpenJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if journal.RunID != testRunID {
+		t.Errorf("RunID = %q, want %q", journal.RunID, testRunID)
+	}
+	if want := []string{"a.algo/AAA/1000", "b.algo/BBB/1000"}; !slices.Equal(journal.order, want) {
+		t.Errorf("order = %v, want %v", journal.order, want)
+	}
+	failed := journal.latest["a.algo/AAA/1000"]
+	if failed.State != JournalFailed || failed.TxID != "TXA" || failed.LastValid != 1100 {
+		t.Errorf("failed after submit = %s txid:%q lastValid:%d, want failed txid:TXA lastValid:1100", failed.State, failed.TxID, failed.LastValid)
+	}
+}
+
+func TestJournalRemainingPlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       []string
+		withIndexer bool
+		want        []string
+		wantUnknown []string
+	}{
+		{
+			name: "planned then crash",
+			lines: []string{
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5}`,
+				`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+			},
+			want: []string{"a.algo/1000/5", "b.algo/1000/6"},
+		},
+		{
+			name: "submitted then crash",
+			lines: []string{
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5}`,
+				`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+				`{"state":"planned","nfd":"c.algo","depositAccount":"CCC","asset":1000,"amount":7}`,
+				`{"state":"planned","nfd":"d.algo","depositAccount":"DDD","asset":1000,"amount":8}`,
+				`{"state":"submitted","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"txid":"TXCONFIRMED","lastValid":1600}`,
+				`{"state":"submitted","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6,"txid":"TXREJECTED","lastValid":1600}`,
+				`{"state":"submitted","nfd":"c.algo","depositAccount":"CCC","asset":1000,"amount":7,"txid":"TXGONE","lastValid":1600}`,
+				// a crash mid-write leaves a partial last line
+				`{"state":"submitted","nfd":"d.al`,
+			},
+			withIndexer: true,
+			// confirmed is skipped, rejected and not on chain are sent again, as is the never submitted one
+			want: []string{"b.algo/1000/6", "c.algo/1000/7", "d.algo/1000/8"},
+		},
+		{
+			name: "submitted with no indexer",
+			lines: []string{
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5}`,
+				`{"state":"submitted","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"txid":"TXGONE","lastValid":1600}`,
+			},
+			// the node no longer knows of it, and there's no indexer to check - it may have landed
+			wantUnknown: []string{"a.algo"},
+		},
+		{
+			name: "failed with a txid",
+			lines: []string{
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5}`,
+				`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+				`{"state":"planned","nfd":"c.algo","depositAccount":"CCC","asset":1000,"amount":7}`,
+				`{"state":"submitted","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"txid":"TXLANDED","lastValid":1450}`,
+				`{"state":"failed","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"error":"waiting for txn: timed out"}`,
+				`{"state":"submitted","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6,"txid":"TXUNKNOWN","lastValid":1450}`,
+				`{"state":"failed","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6,"txid":"TXUNKNOWN","error":"waiting for txn: timed out"}`,
+				// failed before it was sent - no txid
+				`{"state":"failed","nfd":"c.algo","depositAccount":"CCC","asset":1000,"amount":7,"error":"failure getting txns: HTTP 503: busy"}`,
+			},
+			withIndexer: true,
+			// landed is skipped, the indexer failing leaves it unknown, and the unsent one is sent again
+			want:        []string{"c.algo/1000/7"},
+			wantUnknown: []string{"b.algo"},
+		},
+		{
+			name: "duplicate keys",
+			lines: []string{
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5}`,
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":2000,"amount":9}`,
+				`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+				`{"state":"confirmed","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":5,"txid":"TXA","round":1200}`,
+				// a resume planning them again, then confirming one of them again
+				`{"state":"planned","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6}`,
+				`{"state":"planned","nfd":"a.algo","depositAccount":"AAA","asset":2000,"amount":9}`,
+				`{"state":"confirmed","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":6,"txid":"TXB","round":1300}`,
+				// the same nfd with a different deposit account is a different send
+				`{"state":"planned","nfd":"a.algo","depositAccount":"ZZZ","asset":1000,"amount":4}`,
+			},
+			want: []string{"a.algo/2000/9", "a.algo/1000/4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &fakeChain{
+				lastRound: 2000,
+				pending: map[string]models.PendingTransactionInfoResponse{
+					"TXCONFIRMED": {ConfirmedRound: 1500},
+					"TXREJECTED":  {PoolError: "TransactionPool.Remember: transaction TXREJECTED: overspend"},
+				},
+				indexed:       map[string]models.Transaction{"TXLANDED": {ConfirmedRound: 1400}},
+				indexerErrors: map[string]bool{"TXUNKNOWN": true},
+			}
+			setupTestGlobals(t, chain, tt.withIndexer)
+			filename := writeJournalFixture(t, tt.lines...)
+			journal, err := OpenJournal(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var unknown []string
+			for _, entry := range journal.reconcileSubmitted() {
+				unknown = append(unknown, entry.NfdName)
+			}
+			if !slices.Equal(unknown, tt.wantUnknown) {
+				t.Errorf("reconcileSubmitted unknown = %v, want %v", unknown, tt.wantUnknown)
+			}
+			plan, err := journal.remainingPlan(testAssets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := planSummary(plan); !slices.Equal(got, tt.want) {
+				t.Errorf("remainingPlan = %v, want %v", got, tt.want)
+			}
+			journal.Close()
+
+			// what was reconciled was journaled - resuming again plans the same, without checking the chain again
+			chain.pending, chain.indexed = nil, nil
+			reopened, err := OpenJournal(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			plan, err = reopened.remainingPlan(testAssets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := planSummary(plan); !slices.Equal(got, tt.want) {
+				t.Errorf("remainingPlan after reopening = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package algo
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/algod"
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/common"
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/indexer"
 	"github.com/algorand/go-algorand-sdk/v2/types"
 	"github.com/ssgreg/repeat"
 
@@ -42,6 +44,8 @@ func GetAlgoClient(log *slog.Logger, config NetworkConfig, maxConnections int) (
 		if err != nil {
 			return nil, fmt.Errorf("error reading config: %w", err)
 		}
+	} else if len(config.Nodes) > 1 {
+		return getPooledAlgoClient(log, config.Nodes, maxConnections)
 	} else {
 		apiURL = config.NodeURL
 		apiToken = config.NodeToken
@@ -82,7 +86,66 @@ func GetAlgoClient(log *slog.Logger, config NetworkConfig, maxConnections int) (
 	return client, nil
 }
 
+// getPooledAlgoClient returns a client spreading its requests across all the nodes - using the healthy ones, which
+// are checked periodically for as long as the process runs.
+func getPooledAlgoClient(log *slog.Logger, nodes []NodeConfig, maxConnections int) (*algod.Client, error) {
+	for _, node := range nodes {
+		misc.Infof(log, "Using Algorand node at:%s", node.URL)
+	}
+	customTransport := http.DefaultTransport.(*http.Transport).Clone()
+	customTransport.MaxIdleConns = 100
+	customTransport.MaxConnsPerHost = min(100, maxConnections)
+	customTransport.MaxIdleConnsPerHost = 100
+	pool, err := NewNodePool(log, nodes, customTransport)
+	if err != nil {
+		return nil, err
+	}
+	client, err := algod.MakeClientWithTransport(nodePoolAddress, "", nil, pool)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to make pooled algod client, error:%w`, err)
+	}
+	go pool.MonitorHealth(context.Background())
+	return client, nil
+}
+
+// CheckGenesis makes sure the node is on the expected network - matching the genesis id and hash (if specified).
+// The genesis id of the node is returned.
+func CheckGenesis(ctx context.Context, client *algod.Client, genesisID string, genesisHash string) (string, error) {
+	params, err := client.SuggestedParams().Do(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get suggested params from algod client, error:%w", err)
+	}
+	if genesisID != "" && params.GenesisID != genesisID {
+		return params.GenesisID, fmt.Errorf("node is on network %s, not the expected %s", params.GenesisID, genesisID)
+	}
+	if nodeHash := base64.StdEncoding.EncodeToString(params.GenesisHash); genesisHash != "" && nodeHash != genesisHash {
+		return params.GenesisID, fmt.Errorf("node has genesis hash %s, not the expected %s", nodeHash, genesisHash)
+	}
+	return params.GenesisID, nil
+}
+
+// GetIndexerClient returns a client for the indexer configured for the network - nil if there isn't one.
+func GetIndexerClient(log *slog.Logger, config NetworkConfig) (*indexer.Client, error) {
+	if config.IndexerURL == "" {
+		return nil, nil
+	}
+	// Strip off trailing slash if present in url which the Algorand client doesn't handle properly
+	apiURL := strings.TrimRight(config.IndexerURL, "/")
+	client, err := indexer.MakeClient(apiURL, config.IndexerToken)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to make indexer client (url:%s), error:%w`, apiURL, err)
+	}
+	misc.Infof(log, "Using indexer at:%s", apiURL)
+	return client, nil
+}
+
 func SuggestedParams(ctx context.Context, logger *slog.Logger, client *algod.Client) types.SuggestedParams {
+	return SuggestedParamsForFee(ctx, logger, client, false)
+}
+
+// SuggestedParamsForFee returns the suggested params - with a flat minimum fee, or if useSuggestedFee is set, the
+// per-byte fee suggested by the node (raised during congestion) - so the fee of each txn is computed from its size.
+func SuggestedParamsForFee(ctx context.Context, logger *slog.Logger, client *algod.Client, useSuggestedFee bool) types.SuggestedParams {
 	var (
 		txParams types.SuggestedParams
 		err      error
@@ -91,6 +154,10 @@ func SuggestedParams(ctx context.Context, logger *slog.Logger, client *algod.Cli
 	err = repeat.Repeat(
 		repeat.Fn(func() error {
 			txParams, err = client.SuggestedParams().Do(ctx)
+			if err != nil && ctx.Err() != nil {
+				// cancelled - no point retrying
+				return repeat.HintStop(err)
+			}
 			if err != nil {
 				return repeat.HintTemporary(err)
 			}
@@ -108,7 +175,11 @@ func SuggestedParams(ctx context.Context, logger *slog.Logger, client *algod.Cli
 	// don't create a transaction starting at round 100 but the node we submit to is only at round 99
 	txParams.FirstRoundValid--
 	txParams.LastRoundValid = txParams.FirstRoundValid + DefaultValidRoundRange
-	// Just set fixed fee for now - we don't want to send during high cost periods anyway.
+	if useSuggestedFee {
+		// per-byte fee - the txn fee will be the larger of the fee * size, and the min fee
+		txParams.FlatFee = false
+		return txParams
+	}
 	txParams.FlatFee = true
 	txParams.Fee = types.MicroAlgos(txParams.MinFee)
 	return txParams
@@ -21,6 +21,16 @@ type NetworkConfig struct {
 	NodeURL     string
 	NodeToken   string
 	NodeHeaders map[string]string
+	// Nodes is every algod endpoint to use (the first being NodeURL/NodeToken/NodeHeaders) - requests are spread
+	// across all of them if there's more than one
+	Nodes []NodeConfig
+
+	IndexerURL   string
+	IndexerToken string
+
+	// GenesisID and GenesisHash (base64) are what the node is expected to report - checked if set
+	GenesisID   string
+	GenesisHash string
 }
 
 func GetNetworkConfig(network string) NetworkConfig {
@@ -36,28 +46,77 @@ func GetNetworkConfig(network string) NetworkConfig {
 		cfg.NFDAPIUrl = nfdAPIUrl
 	}
 
-	nodeURL := misc.GetSecret("ALGO_ALGOD_URL")
-	if nodeURL != "" {
-		cfg.NodeURL = nodeURL
+	// multiple algod endpoints can be specified as comma separated urls (with comma separated tokens)
+	nodeURLs := splitList(misc.GetSecret("ALGO_ALGOD_URL"), ",")
+	if len(nodeURLs) > 0 {
+		cfg.NodeURL = nodeURLs[0]
+	} else {
+		nodeURLs = []string{cfg.NodeURL}
+	}
+
+	nodeTokens := splitList(misc.GetSecret("ALGO_ALGOD_TOKEN"), ",")
+	if len(nodeTokens) > 0 {
+		cfg.NodeToken = nodeTokens[0]
+	}
+	indexerURL := misc.GetSecret("ALGO_INDEXER_URL")
+	if indexerURL != "" {
+		cfg.IndexerURL = indexerURL
 	}
 
-	nodeToken := misc.GetSecret("ALGO_ALGOD_TOKEN")
-	if nodeToken != "" {
-		cfg.NodeToken = nodeToken
+	indexerToken := misc.GetSecret("ALGO_INDEXER_TOKEN")
+	if indexerToken != "" {
+		cfg.IndexerToken = indexerToken
 	}
-	NodeHeaders := misc.GetSecret("ALGO_ALGOD_HEADERS")
-	// parse NodeHeaders from key:value,[key:value...] pairs and put into cfg.NodeHeaders map
-	cfg.NodeHeaders = map[string]string{}
-	for _, header := range strings.Split(NodeHeaders, ",") {
+
+	genesisID := os.Getenv("ALGO_GENESIS_ID")
+	if genesisID != "" {
+		cfg.GenesisID = genesisID
+	}
+
+	genesisHash := os.Getenv("ALGO_GENESIS_HASH")
+	if genesisHash != "" {
+		cfg.GenesisHash = genesisHash
+	}
+	// headers of multiple endpoints are separated by ;'s
+	nodeHeaders := strings.Split(misc.GetSecret("ALGO_ALGOD_HEADERS"), ";")
+	cfg.NodeHeaders = parseHeaders(nodeHeaders[0])
+
+	for i, nodeURL := range nodeURLs {
+		node := NodeConfig{URL: nodeURL, Token: cfg.NodeToken, Headers: cfg.NodeHeaders}
+		if i < len(nodeTokens) {
+			node.Token = nodeTokens[i]
+		}
+		if i < len(nodeHeaders) {
+			node.Headers = parseHeaders(nodeHeaders[i])
+		}
+		cfg.Nodes = append(cfg.Nodes, node)
+	}
+
+	return cfg
+}
+
+// parseHeaders parses key:value,[key:value...] pairs into a map
+func parseHeaders(headers string) map[string]string {
+	parsed := map[string]string{}
+	for _, header := range strings.Split(headers, ",") {
 		parts := strings.SplitN(header, ":", 2) // Just split on first : - they can have :'s in value.
 		if len(parts) == 2 {
 			key := strings.TrimSpace(parts[0])
 			value := strings.TrimSpace(parts[1])
-			cfg.NodeHeaders[key] = value
+			parsed[key] = value
 		}
 	}
+	return parsed
+}
 
-	return cfg
+func splitList(list string, sep string) []string {
+	var values []string
+	for _, value := range strings.Split(list, sep) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
 
 func getDefaults(network string) NetworkConfig {
@@ -66,12 +125,28 @@ func getDefaults(network string) NetworkConfig {
 	case "mainnet":
 		cfg.NFDAPIUrl = "https://api.nf.domains"
 		cfg.NodeURL = "https://mainnet-api.4160.nodely.dev"
+		cfg.IndexerURL = "https://mainnet-idx.4160.nodely.dev"
+		cfg.GenesisID = "mainnet-v1.0"
+		cfg.GenesisHash = "wGHE2Pwdvd7S12BL5FaOP20EGYesN73ktiC1qzkkit8="
 	case "testnet":
 		cfg.NFDAPIUrl = "https://api.testnet.nf.domains"
 		cfg.NodeURL = "https://testnet-api.4160.nodely.dev"
+		cfg.IndexerURL = "https://testnet-idx.4160.nodely.dev"
+		cfg.GenesisID = "testnet-v1.0"
+		cfg.GenesisHash = "SGO1GKSzyE7IEPItTxCByw9x8FmnrCDexi9/cOUJOiI="
 	case "betanet":
 		cfg.NFDAPIUrl = "https://api.betanet.nf.domains"
 		cfg.NodeURL = "https://betanet-api.4160.nodely.dev"
+		cfg.IndexerURL = "https://betanet-idx.4160.nodely.dev"
+		cfg.GenesisID = "betanet-v1.0"
+	case "localnet":
+		// the defaults of an AlgoKit localnet - there's no NFD API (unless ALGO_NFD_URL is set)
+		cfg.NodeURL = "http://localhost:4001"
+		cfg.NodeToken = strings.Repeat("a", 64)
+		cfg.IndexerURL = "http://localhost:8980"
+		cfg.IndexerToken = strings.Repeat("a", 64)
+	case "custom":
+		// everything has to come from the environment (or flags)
 	}
 	return cfg
 }
@@ -0,0 +1,222 @@
+package algo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/algod"
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+const (
+	// how often every node of a pool is checked
+	nodeHealthCheckInterval = 5 * time.Second
+	// how many rounds a node can be behind the furthest along node and still be used
+	nodeMaxRoundsBehind = 2
+	// the address the pools algod client is made with - every request is sent to a node of the pool instead
+	nodePoolAddress  = "http://algod-pool"
+	algodTokenHeader = "X-Algo-API-Token"
+)
+
+// NodeConfig is a single algod endpoint
+type NodeConfig struct {
+	URL     string            `json:"url"`
+	Token   string            `json:"token"`
+	Headers map[string]string `json:"headers"`
+}
+
+type poolNode struct {
+	url       *url.URL
+	token     string
+	headers   map[string]string
+	client    *algod.Client // for health checks
+	healthy   atomic.Bool
+	lastRound uint64
+}
+
+// NodePool spreads algod requests across multiple nodes - taking nodes out while they're erroring or falling
+// behind the others, and putting them back once they've caught up.  It's used as the transport of a single
+// algod client, so callers needn't know there's more than one node.
+type NodePool struct {
+	log       *slog.Logger
+	nodes     []*poolNode
+	next      atomic.Uint64
+	transport http.RoundTripper
+	mu        sync.Mutex // for health checks
+}
+
+// NewNodePool makes a pool of the specified nodes, doing an initial health check of each - failing if none
+// are healthy.
+func NewNodePool(log *slog.Logger, nodes []NodeConfig, transport http.RoundTripper) (*NodePool, error) {
+	pool := &NodePool{log: log, transport: transport}
+	for _, node := range nodes {
+		nodeURL, err := url.Parse(strings.TrimRight(node.URL, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url:%v, error:%w", node.URL, err)
+		}
+		if nodeURL.Scheme == "tcp" {
+			nodeURL.Scheme = "http"
+		}
+		var headers []*common.Header
+		for key, value := range node.Headers {
+			headers = append(headers, &common.Header{Key: key, Value: value})
+		}
+		client, err := algod.MakeClientWithTransport(nodeURL.String(), node.Token, headers, transport)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to make algod client (url:%s), error:%w`, nodeURL.String(), err)
+		}
+		pool.nodes = append(pool.nodes, &poolNode{url: nodeURL, token: node.Token, headers: node.Headers, client: client})
+	}
+	pool.checkHealth()
+	for _, node := range pool.nodes {
+		if node.healthy.Load() {
+			return pool, nil
+		}
+	}
+	return nil, fmt.Errorf("none of the %d algod nodes are reachable", len(pool.nodes))
+}
+
+// MonitorHealth checks the health of every node periodically until the context is done
+func (p *NodePool) MonitorHealth(ctx context.Context) {
+	ticker := time.NewTicker(nodeHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth fetches the status of every node - nodes that error, or are behind the furthest along node, are
+// taken out until they recover.
+func (p *NodePool) checkHealth() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var (
+		wg       sync.WaitGroup
+		errs     = make([]error, len(p.nodes))
+		maxRound uint64
+	)
+	for i, node := range p.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), nodeHealthCheckInterval)
+			defer cancel()
+			status, err := node.client.Status().Do(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			node.lastRound = status.LastRound
+		}()
+	}
+	wg.Wait()
+	for i, node := range p.nodes {
+		if errs[i] == nil {
+			maxRound = max(maxRound, node.lastRound)
+		}
+	}
+	for i, node := range p.nodes {
+		switch {
+		case errs[i] != nil:
+			p.setHealthy(node, false, fmt.Sprintf("error:%v", errs[i]))
+		case node.lastRound+nodeMaxRoundsBehind < maxRound:
+			p.setHealthy(node, false, fmt.Sprintf("at round %d, %d behind", node.lastRound, maxRound-node.lastRound))
+		default:
+			p.setHealthy(node, true, fmt.Sprintf("at round %d", node.lastRound))
+		}
+	}
+}
+
+func (p *NodePool) setHealthy(node *poolNode, healthy bool, reason string) {
+	if node.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		misc.Infof(p.log, "algod node %s is healthy (%s) - using it", node.url.Host, reason)
+	} else {
+		misc.Infof(p.log, "algod node %s is unhealthy (%s) - taking it out", node.url.Host, reason)
+	}
+}
+
+// pick returns the nodes to try a request on, in order - the healthy nodes, rotating which is first so requests
+// are spread across them, then the rest in case they've all been taken out.
+func (p *NodePool) pick() []*poolNode {
+	var (
+		start     = int(p.next.Add(1))
+		healthy   []*poolNode
+		unhealthy []*poolNode
+	)
+	for i := range p.nodes {
+		node := p.nodes[(start+i)%len(p.nodes)]
+		if node.healthy.Load() {
+			healthy = append(healthy, node)
+		} else {
+			unhealthy = append(unhealthy, node)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// RoundTrip sends the request to a node of the pool - trying the next if the node can't be reached or is
+// unavailable (taking it out until it's healthy again).
+func (p *NodePool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		nodes = p.pick()
+		body  = req.Body
+	)
+	for i, node := range nodes {
+		nodeReq := req.Clone(req.Context())
+		nodeReq.Body = body
+		nodeReq.URL.Scheme = node.url.Scheme
+		nodeReq.URL.Host = node.url.Host
+		nodeReq.URL.Path = node.url.Path + req.URL.Path
+		nodeReq.Host = node.url.Host
+		nodeReq.Header.Set(algodTokenHeader, node.token)
+		for key, value := range node.headers {
+			nodeReq.Header.Set(key, value)
+		}
+		resp, err := p.transport.RoundTrip(nodeReq)
+		if err == nil && !isUnavailable(resp.StatusCode) {
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		if err != nil {
+			p.setHealthy(node, false, fmt.Sprintf("error:%v", err))
+		} else {
+			p.setHealthy(node, false, fmt.Sprintf("status:%s", resp.Status))
+		}
+		canResend := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if i == len(nodes)-1 || !canResend {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			if body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("no algod nodes configured")
+}
+
+func isUnavailable(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
@@ -0,0 +1,73 @@
+package algo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/algod"
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+	"github.com/algorand/go-algorand-sdk/v2/encoding/msgpack"
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// DecodeSignedTxns decodes the concatenated signed transaction bytes (as sent to SendRawTransaction) back into
+// the individual signed transactions.
+func DecodeSignedTxns(txnBytes []byte) ([]types.SignedTxn, error) {
+	var (
+		stxns []types.SignedTxn
+		dec   = msgpack.NewDecoder(bytes.NewReader(txnBytes))
+	)
+	for {
+		var stxn types.SignedTxn
+		err := dec.Decode(&stxn)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding signed txn %d: %w", len(stxns), err)
+		}
+		stxns = append(stxns, stxn)
+	}
+	return stxns, nil
+}
+
+// SimulateTxns runs the signed transaction (or group) through the simulate endpoint of algod - evaluating it against
+// the current ledger state without sending it.  The result of the group is returned - with FailureMessage set if
+// it would fail.
+func SimulateTxns(ctx context.Context, algoClient *algod.Client, txnBytes []byte) (models.SimulateTransactionGroupResult, error) {
+	stxns, err := DecodeSignedTxns(txnBytes)
+	if err != nil {
+		return models.SimulateTransactionGroupResult{}, err
+	}
+	resp, err := algoClient.SimulateTransaction(models.SimulateRequest{
+		TxnGroups: []models.SimulateRequestTransactionGroup{{Txns: stxns}},
+	}).Do(ctx)
+	if err != nil {
+		return models.SimulateTransactionGroupResult{}, fmt.Errorf("simulate failed: %w", err)
+	}
+	if len(resp.TxnGroups) != 1 {
+		return models.SimulateTransactionGroupResult{}, fmt.Errorf("simulate returned %d groups, expected 1", len(resp.TxnGroups))
+	}
+	return resp.TxnGroups[0], nil
+}
+
+// SimulatedFees returns the total fees paid by the simulated group, including any inner transactions, and the
+// number of inner transactions.
+func SimulatedFees(result models.SimulateTransactionGroupResult) (fees uint64, numInner int) {
+	var addInner func(txns []models.PendingTransactionResponse)
+	addInner = func(txns []models.PendingTransactionResponse) {
+		for _, inner := range txns {
+			fees += uint64(inner.Transaction.Txn.Fee)
+			numInner++
+			addInner(inner.InnerTxns)
+		}
+	}
+	for _, txnResult := range result.TxnResults {
+		fees += uint64(txnResult.TxnResult.Transaction.Txn.Fee)
+		addInner(txnResult.TxnResult.InnerTxns)
+	}
+	return fees, numInner
+}
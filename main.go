@@ -8,7 +8,9 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/algod"
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
@@ -21,7 +23,7 @@ import (
 
 // This is simple CLI - global vars here are fine... get over it.
 var (
-	ctx                  = context.Background()
+	ctx, cancelCtx       = context.WithCancel(context.Background()) // cancelled on a second interrupt - see handleShutdownSignals
 	algoClient           *algod.Client
 	api                  *nfdapi.APIClient
 	logger               *slog.Logger
@@ -29,24 +31,82 @@ var (
 	sendConfig           *BatchSendConfig
 	vaultNfd             *nfdapi.NfdRecord
 	sourceAccount        types.Address // the account we truly send from -used for fetching sender balances, etc.
+	runID                string        // identifies this run (and any resumption of it) - used for leases/notes
+	runDir               string        // directory the journal and results of this run are written to
 	maxSimultaneousSends = 40
+	groupSize            = 0                // direct sends to combine into each atomic group - 0 or 1 sends each on its own
+	maxSendAttempts      = 3                // times a send is (re)built and sent if its validity window passes without it landing
+	algodRateLimit       = 0.0              // max algod calls per second (0 for no limit) - lowered automatically if rate limited
+	nfdRateLimit         = 65.0             // max NFD API calls per second - lowered automatically if rate limited
+	nfdParallel          = 40               // max NFD API calls at once - lowered automatically if rate limited
+	networkOverrides     algo.NetworkConfig // algod url/token, NFD API url, and expected genesis set by flags
 )
 
 func main() {
-	network := flag.String("network", "mainnet", "network: mainnet, testnet, betanet, or override w/ ALGO_XX env vars")
+	network := flag.String("network", "mainnet", "network: mainnet, testnet, betanet, localnet, custom, or override w/ ALGO_XX env vars")
 	sender := flag.String("sender", "", "account which has to sign all transactions - must have mnemonics in a ALGO_MNEMONIC_xx var")
 	vault := flag.String("vault", "", "Don't send from sender account but from the named NFD vault that sender is owner of")
 	config := flag.String("config", "send.json", "path to json config file specifying what to send and to what recipients")
-	dryrun := flag.Bool("dryrun", false, "dryrun just shows what would've been sent but doesn't actually send")
+	dryrun := flag.Bool("dryrun", false, "dryrun builds and simulates every send (reporting if it would succeed) but doesn't actually send")
 	parallel := flag.Int("parallel", maxSimultaneousSends, "maximum number of sends to do at once - target node may limit")
+	resume := flag.String("resume", "", "resume an interrupted run from its journal file - skipping sends already confirmed")
+	resultsFormat := flag.String("results", "", "also write a structured record of every send to the run directory: jsonl or csv")
+	retry := flag.String("retry", "", "retry just the failed sends of a prior run from its journal or results file - skipping failures that can't succeed")
+	verify := flag.String("verify", "", "verify the sends recorded in a journal or results file against the chain (then exit)")
+	attempts := flag.Int("attempts", maxSendAttempts, "maximum times to send each transfer - resending if it expires without being confirmed")
+	group := flag.Int("group", groupSize, "combine up to this many (max 16) direct, non-vault, sends into each atomic transaction group")
+	algodRate := flag.Float64("algodrate", algodRateLimit, "maximum algod calls per second (0 for no limit) - lowered automatically while the node is rate limiting")
+	nfdRate := flag.Float64("nfdrate", nfdRateLimit, "maximum NFD API calls per second - lowered automatically while the API is rate limiting")
+	nfdParallelCalls := flag.Int("nfdparallel", nfdParallel, "maximum NFD API calls to make at once - lowered automatically while the API is rate limiting")
+	flag.StringVar(&networkOverrides.NodeURL, "algod", "", "algod url to use - overriding ALGO_ALGOD_URL (required for a custom network)")
+	flag.StringVar(&networkOverrides.NodeToken, "algodtoken", "", "algod token to use - overriding ALGO_ALGOD_TOKEN")
+	flag.StringVar(&networkOverrides.NFDAPIUrl, "nfdapi", "", "NFD API url to use - overriding ALGO_NFD_URL.  Without one (localnet or custom networks) NFD features are disabled")
+	flag.StringVar(&networkOverrides.GenesisID, "genesisid", "", "genesis id the node must be on - overriding ALGO_GENESIS_ID (and the mainnet/testnet/betanet defaults)")
+	flag.StringVar(&networkOverrides.GenesisHash, "genesishash", "", "genesis hash (base64) the node must be on - overriding ALGO_GENESIS_HASH")
 	flag.Parse()
 	maxSimultaneousSends = *parallel
+	algodRateLimit = *algodRate
+	nfdRateLimit = *nfdRate
+	nfdParallel = max(*nfdParallelCalls, 1)
+	groupSize = *group
+	maxSendAttempts = max(*attempts, 1)
 
 	initLogger()
 	ensureValidParams(*network, *sender)
+	if *resume != "" && *retry != "" {
+		flag.Usage()
+		log.Fatalln("only one of -resume or -retry can be specified")
+	}
+	if *resultsFormat != "" && *resultsFormat != ResultsJSONL && *resultsFormat != ResultsCSV {
+		flag.Usage()
+		log.Fatalln("unknown results format:", *resultsFormat)
+	}
 	loadEnvironmentSettings()
-	initSigner(*sender)   // also ensures we have mnemonics for it
+	if *verify != "" {
+		// nothing is sent so no sender (or config) needed
+		initClients(*network)
+		if verifySends(*verify, *network) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	initSigner(*sender) // also ensures we have mnemonics for it
+	// From here on, an interrupt stops the run cleanly - before sending anything if still planning
+	stopping := handleShutdownSignals()
+
+	misc.Infof(logger, "loading json config from:%s", *config)
+	var err error
+	sendConfig, err = loadJSONConfig(*config)
+	if err != nil {
+		log.Fatalln("error loading json config from:", *config, "error:", err)
+	}
+	if err := validateFeeChoice(sendConfig.Fees); err != nil {
+		log.Fatalln(err)
+	}
 	initClients(*network) // algod and nfd api
+	if err := checkNfdFeatures(sendConfig, *vault); err != nil {
+		log.Fatalln(err)
+	}
 
 	// Get account balance info for sender for later...
 	senderInfo, err := algo.GetBareAccount(ctx, algoClient, *sender)
@@ -55,11 +115,6 @@ func main() {
 	}
 
 	sourceAccount, _ = types.DecodeAddress(*sender)
-	misc.Infof(logger, "loading json config from:%s", *config)
-	sendConfig, err = loadJSONConfig(*config)
-	if err != nil {
-		log.Fatalln("error loading json config from:", *config, "error:", err)
-	}
 
 	// if vault specified - make sure its valid and sender is owner
 	if *vault != "" {
@@ -76,27 +131,139 @@ func main() {
 	}
 
 	// Collect set of assets to send, so we can determine distribution
-	assetsToSend, err := fetchAssets(sendConfig)
+	var assetsToSend []*SendAsset
+	if sendConfig.Send.Nfts != nil {
+		if len(sendConfig.Send.AssetChoices()) > 0 {
+			log.Fatalln("send configuration can't specify both nfts and asset(s)")
+		}
+		assetsToSend, err = fetchNftPool(sendConfig)
+	} else {
+		assetsToSend, err = fetchAssets(sendConfig)
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
 	if len(assetsToSend) == 0 {
 		log.Fatalln("No assets to send")
 	}
-	misc.Infof(logger, "Want to send")
-	for _, asset := range assetsToSend {
-		misc.Infof(logger, "  %s", asset)
+	if sendConfig.Send.Nfts != nil {
+		misc.Infof(logger, "Want to send from a pool of %d NFTs", len(assetsToSend))
+	} else {
+		misc.Infof(logger, "Want to send")
+		for _, asset := range assetsToSend {
+			misc.Infof(logger, "  %s", asset)
+		}
 	}
 
 	var (
-		recipients []*Recipient
+		plan    []*PlannedSend
+		journal *SendJournal
 	)
+	// older txns (of a prior run, or that expired) can only be looked up via the indexer
+	initIndexer(*network)
+	if *resume != "" {
+		// Everything to send comes from the journal of the prior run, not from collecting recipients again
+		journal, err = OpenJournal(*resume)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer journal.Close()
+		runID = journal.RunID
+		runDir = filepath.Dir(*resume)
+		misc.Infof(logger, "Resuming run:%s", runID)
+		misc.Infof(logger, "Checking sends of prior run whose outcome wasn't recorded")
+		for _, entry := range journal.reconcileSubmitted() {
+			misc.Infof(logger, "..UNKNOWN outcome of txid:%s to %s - not retrying, check manually", entry.TxID, entry.NfdName)
+		}
+		if plan, err = journal.remainingPlan(assetsToSend); err == nil {
+			plan, err = checkResumedOptIns(plan)
+		}
+	} else if *retry != "" {
+		// A new run of just the failed sends - keeping the run id (and so the leases) of the prior run
+		if runID, plan, err = retryPlan(*retry, assetsToSend); err == nil {
+			// a new run (and journal), so sends can go to vaults instead as with any run
+			plan, _, err = checkOptIns(sendConfig.Destination.NotOptedIn, plan, map[string]bool{})
+		}
+		runDir = filepath.Join("runs", fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), runID))
+		misc.Infof(logger, "Retrying failed sends of run:%s", runID)
+	} else {
+		runID = newRunID()
+		runDir = filepath.Join("runs", fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), runID))
+		misc.Infof(logger, "Starting run:%s", runID)
+		plan, err = planFromConfig(assetsToSend)
+	}
+	if err != nil {
+		log.Fatalln("error planning sends:", err)
+	}
+	if len(plan) == 0 {
+		misc.Infof(logger, "Nothing to send")
+		return
+	}
+
+	// If sending to vaults, assume worst case of each needing opting in, so MBR + 4 total outer/inner txns
+	// if not to vaults, just asset-transfer (recipients not opted-in were already skipped or sent to their vault)
+	// Every planned send is a separate send, paying the fee per txn of the fee policy.
+	var (
+		expectedFees uint64
+		txnFee       = expectedTxnFee()
+	)
+	misc.Infof(logger, "Fees:%s - expecting %s ALGO per txn", sendConfig.Fees.String(), algo.FormattedAlgoAmount(txnFee))
+	for _, send := range plan {
+		if send.recipient.SendToVault {
+			expectedFees += 100000 + 4*txnFee
+		} else {
+			expectedFees += txnFee
+		}
+	}
+	checkBalanceReqs(senderInfo, expectedFees)
+	// If ALGO is sent directly from the sender, the fees come out of that same balance
+	var reservedAlgo uint64
+	if vaultNfd == nil {
+		reservedAlgo = expectedFees
+	}
+	// Make sure the balances are acceptable
+	verifyAssetBalances(assetsToSend, plan, reservedAlgo)
+
+	if isStopping(stopping) {
+		misc.Infof(logger, "Stopped before sending - nothing was sent")
+		return
+	}
+	PromptForConfirmation("Are you sure you want to proceed? (y/n): ", stopping)
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		log.Fatalln("error creating run directory:", err)
+	}
+	misc.Infof(logger, "Writing results to %s", runDir)
+	if journal == nil && !*dryrun {
+		journal, err = CreateJournal(filepath.Join(runDir, "journal.jsonl"), runID)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer journal.Close()
+		journal.recordPlanned(plan)
+	}
+	var results *ResultsFile
+	if *resultsFormat != "" {
+		results, err = OpenResultsFile(runDir, *resultsFormat)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer results.Close()
+	}
+	sendAssets(*sender, assetsToSend, plan, vaultNfd, journal, results, *dryrun, stopping)
+}
 
+// planFromConfig collects the recipients specified by the destination configuration and determines exactly
+// what will be sent to each.
+func planFromConfig(assetsToSend []*SendAsset) ([]*PlannedSend, error) {
 	misc.Infof(logger, "Collecting data for config:%s", sendConfig.Destination.String())
-	recipients, err = collectRecipients(sendConfig, vaultNfd)
+	recipients, err := collectRecipients(sendConfig, vaultNfd)
 	misc.Infof(logger, "Collected %d recipients", len(recipients))
 	if err != nil {
-		log.Fatalln("error collecting recipients:", err)
+		return nil, fmt.Errorf("error collecting recipients: %w", err)
+	}
+
+	if err := applyDistributionWeights(sendConfig, recipients); err != nil {
+		return nil, fmt.Errorf("error determining distribution weights: %w", err)
 	}
 
 	if !sendConfig.Destination.AllowDuplicateAccounts {
@@ -107,19 +274,62 @@ func main() {
 			recipients = uniqRecipients
 		}
 	}
-	// If sending to vaults, assume worst case of each needing opting in, so MBR + 4 total outer/inner txns
-	// if not to vaults, just asset-transfer but if target not opted-in most txns will fail
-	if sendConfig.Destination.SendToVaults {
-		checkBalanceReqs(senderInfo, uint64(104000*len(recipients)))
-	} else {
-		checkBalanceReqs(senderInfo, uint64(1000*len(recipients)))
+	sortByDepositAccount(recipients)
+	if sendConfig.Send.Nfts != nil {
+		// NFT pool only contains NFTs we hold, so just need to hand them out (and save the assignments)
+		if recipients, err = assignNfts(sendConfig, recipients, assetsToSend); err != nil {
+			return nil, fmt.Errorf("error assigning nfts: %w", err)
+		}
 	}
-	// Make sure the balances are acceptable
-	verifyAssetBalances(assetsToSend, len(recipients))
+	// Recipients not opted-in are only known once there's a plan - if any are dropped from a shared total, plan
+	// again without them so their shares go to the rest rather than being left unsent.
+	var (
+		optedIn  = map[string]bool{}
+		excluded = map[string]bool{}
+	)
+	for {
+		plan, err := planSends(assetsToSend, recipients, excluded)
+		if err != nil {
+			return nil, err
+		}
+		plan, skipped, err := checkOptIns(sendConfig.Destination.NotOptedIn, plan, optedIn)
+		if err != nil {
+			return nil, err
+		}
+		var reshare bool
+		for _, send := range skipped {
+			excluded[optInKey(send)] = true
+			reshare = reshare || (sendConfig.Send.Nfts == nil && !send.asset.IsAmountPerRecip)
+		}
+		if !reshare {
+			return plan, nil
+		}
+		misc.Infof(logger, "..sharing the total again without the %d recipients not opted-in", len(skipped))
+	}
+}
 
-	sortByDepositAccount(recipients)
-	PromptForConfirmation("Are you sure you want to proceed? (y/n): ")
-	sendAssets(*sender, assetsToSend, recipients, vaultNfd, *dryrun)
+// checkResumedOptIns checks the opt-ins of the sends left to resume - recipients may have opted-out since.  The
+// amounts were fixed by the original plan so aren't shared again, and sends to recipients not opted-in are only
+// skipped (staying planned in the journal for a later resume) rather than going to their vault - as the journal
+// tracks each send by its deposit account.
+func checkResumedOptIns(plan []*PlannedSend) ([]*PlannedSend, error) {
+	policy := sendConfig.Destination.NotOptedIn
+	if policy == NotOptedInVault {
+		misc.Infof(logger, "..resuming - sends to recipients not opted-in are skipped rather than sent to their vault")
+		policy = NotOptedInSkip
+	}
+	plan, skipped, err := checkOptIns(policy, plan, map[string]bool{})
+	if err != nil || sendConfig.Send.Nfts != nil {
+		return plan, err
+	}
+	unsent := map[*SendAsset]uint64{}
+	for _, send := range skipped {
+		unsent[send.asset] += send.amount
+	}
+	for asset, total := range unsent {
+		misc.Infof(logger, "..%s of asset %d planned for recipients not opted-in is left unsent", asset.formattedAmount(total), asset.AssetID)
+	}
+	return plan, nil
 }
 
 func checkBalanceReqs(senderInfo models.Account, expectedFees uint64) {
@@ -132,43 +342,66 @@ func checkBalanceReqs(senderInfo models.Account, expectedFees uint64) {
 func fetchAssets(config *BatchSendConfig) ([]*SendAsset, error) {
 	// Fetch/verify asset info user specified in send configuration
 	assetsToSend := []*SendAsset{}
-	assetId := sendConfig.Send.Asset.ASA
-	assetInfo, err := algoClient.GetAssetByID(assetId).Do(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching asset info for ASA:%d, err:%w", assetId, err)
-	}
+	seen := map[uint64]bool{}
+	for _, choice := range config.Send.AssetChoices() {
+		assetId := choice.ASA
+		if seen[assetId] {
+			return nil, fmt.Errorf("ASA:%d is specified more than once in send configuration", assetId)
+		}
+		seen[assetId] = true
+		if assetId == AlgoAssetID {
+			// Sending ALGO itself - the MBR of the source account is unspendable
+			sourceInfo, err := algo.GetBareAccount(ctx, algoClient, sourceAccount.String())
+			if err != nil {
+				return nil, fmt.Errorf("error fetching account info for account:%s, err:%w", sourceAccount.String(), err)
+			}
+			sendAsset, err := NewSendAsset(choice, algoAssetParams, sourceInfo.Amount-min(sourceInfo.Amount, sourceInfo.MinBalance))
+			if err != nil {
+				return nil, err
+			}
+			assetsToSend = append(assetsToSend, sendAsset)
+			continue
+		}
+		assetInfo, err := algoClient.GetAssetByID(assetId).Do(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching asset info for ASA:%d, err:%w", assetId, err)
+		}
 
-	holdingInfo, err := algoClient.AccountAssetInformation(sourceAccount.String(), assetId).Do(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching asset info for ASA:%d from account:%s, err:%w", assetId, sourceAccount.String(), err)
-	}
-	assetsToSend = append(assetsToSend, &SendAsset{
-		AssetID:          assetId,
-		AssetParams:      assetInfo.Params,
-		ExistingBalance:  holdingInfo.AssetHolding.Amount,
-		AmountToSend:     config.Send.Asset.Amount,
-		IsAmountPerRecip: config.Send.Asset.IsPerRecip,
-		Note:             config.Send.Asset.Note,
-	})
+		holdingInfo, err := algoClient.AccountAssetInformation(sourceAccount.String(), assetId).Do(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching asset info for ASA:%d from account:%s, err:%w", assetId, sourceAccount.String(), err)
+		}
+		sendAsset, err := NewSendAsset(choice, assetInfo.Params, holdingInfo.AssetHolding.Amount)
+		if err != nil {
+			return nil, err
+		}
+		assetsToSend = append(assetsToSend, sendAsset)
+	}
 	return assetsToSend, nil
 }
 
-func verifyAssetBalances(send []*SendAsset, numRecipients int) {
+// verifyAssetBalances makes sure the source account has enough of each asset to cover the planned sends.
+// reservedAlgo is the amount of ALGO (beyond MBR) which has to be left for fees if ALGO is being sent as well.
+func verifyAssetBalances(send []*SendAsset, plan []*PlannedSend, reservedAlgo uint64) {
+	totals := plannedTotals(plan)
 	for _, asset := range send {
 		balance := asset.ExistingBalance
-		amountToSend := asset.AmountToSend
-		if asset.IsAmountPerRecip {
-			amountToSend *= float64(numRecipients)
+		if asset.IsAlgo() {
+			balance -= min(balance, reservedAlgo)
 		}
-		if balance < asset.amountInBaseUnits(amountToSend) {
-			log.Fatalf("Insufficient balance for asset %d (%s): Existing balance: %s, Amount to send: %f", asset.AssetID, asset.AssetParams.UnitName, asset.formattedAmount(balance), amountToSend)
+		if balance < totals[asset.AssetID] {
+			log.Fatalf("Insufficient balance for asset %d (%s): Existing balance: %s, Amount to send: %s", asset.AssetID, asset.AssetParams.UnitName, asset.formattedAmount(balance), asset.formattedAmount(totals[asset.AssetID]))
 		}
 	}
 }
 
 func ensureValidParams(network string, sender string) {
+	if groupSize < 0 || groupSize > maxGroupSize {
+		flag.Usage()
+		log.Fatalln("group size must be between 0 and", maxGroupSize)
+	}
 	switch network {
-	case "betanet", "testnet", "mainnet":
+	case "betanet", "testnet", "mainnet", "localnet", "custom":
 		return
 	default:
 		flag.Usage()
@@ -198,22 +431,73 @@ func initSigner(sender string) {
 
 func initClients(network string) {
 	cfg := algo.GetNetworkConfig(network)
+	if sendConfig != nil && len(sendConfig.Nodes) > 0 {
+		// algod endpoints in the config take precedence over the environment
+		cfg.NodeDataDir = ""
+		cfg.NodeURL, cfg.NodeToken, cfg.NodeHeaders = sendConfig.Nodes[0].URL, sendConfig.Nodes[0].Token, sendConfig.Nodes[0].Headers
+		cfg.Nodes = sendConfig.Nodes
+	}
+	if networkOverrides.NodeURL != "" {
+		cfg.NodeDataDir = ""
+		cfg.NodeURL = networkOverrides.NodeURL
+		cfg.Nodes = []algo.NodeConfig{{URL: cfg.NodeURL, Token: cfg.NodeToken, Headers: cfg.NodeHeaders}}
+	}
+	if networkOverrides.NodeToken != "" {
+		cfg.NodeToken = networkOverrides.NodeToken
+		for i := range cfg.Nodes {
+			cfg.Nodes[i].Token = networkOverrides.NodeToken
+		}
+	}
+	if networkOverrides.NFDAPIUrl != "" {
+		cfg.NFDAPIUrl = networkOverrides.NFDAPIUrl
+	}
+	if networkOverrides.GenesisID != "" {
+		cfg.GenesisID = networkOverrides.GenesisID
+	}
+	if networkOverrides.GenesisHash != "" {
+		cfg.GenesisHash = networkOverrides.GenesisHash
+	}
+	if cfg.NodeURL == "" && cfg.NodeDataDir == "" {
+		flag.Usage()
+		log.Fatalln("no algod url for network:", network, "- specify with -algod or ALGO_ALGOD_URL")
+	}
 	var err error
 	algoClient, err = algo.GetAlgoClient(logger, cfg, maxSimultaneousSends)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	nfdApiCfg := nfdapi.NewConfiguration()
-	nfdApiCfg.BasePath = cfg.NFDAPIUrl
-	api = nfdapi.NewAPIClient(nfdApiCfg)
+	genesisID, err := algo.CheckGenesis(ctx, algoClient, cfg.GenesisID, cfg.GenesisHash)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	misc.Infof(logger, "Connected to network:%s", genesisID)
+	if cfg.NFDAPIUrl == "" {
+		misc.Infof(logger, "No NFD API configured - NFD features are disabled")
+	} else {
+		nfdApiCfg := nfdapi.NewConfiguration()
+		nfdApiCfg.BasePath = cfg.NFDAPIUrl
+		api = nfdapi.NewAPIClient(nfdApiCfg)
+	}
+
+	// sends at once (for algod), and calls at once for the NFD API
+	algodThrottle = newThrottle("algod", algodRateLimit, maxSimultaneousSends)
+	nfdThrottle = newThrottle("nfd api", nfdRateLimit, nfdParallel)
 }
 
-func PromptForConfirmation(prompt string) {
-	reader := bufio.NewReader(os.Stdin)
+func PromptForConfirmation(prompt string, stopping <-chan struct{}) {
+	answer := make(chan string, 1)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		text, _ := reader.ReadString('\n')
+		answer <- strings.TrimSpace(text)
+	}()
 	fmt.Print(prompt)
-	text, _ := reader.ReadString('\n')
-	text = strings.TrimSpace(text)
-	if text != "y" && text != "Y" {
+	select {
+	case text := <-answer:
+		if text != "y" && text != "Y" {
+			log.Fatalln("Operation cancelled")
+		}
+	case <-stopping:
 		log.Fatalln("Operation cancelled")
 	}
 }
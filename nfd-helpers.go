@@ -78,14 +78,66 @@ func IsVaultAutoOptInLockedForSender(n *nfdapi.NfdRecord, sender string) bool {
 	return sender != n.Owner
 }
 
+// canReceiveToVault returns true if assets can be sent to the vault of the NFD by anyone - the contract has to be
+// at least 2.11 and the vault not locked.
+func canReceiveToVault(n *nfdapi.NfdRecord) bool {
+	if n.Properties == nil {
+		return false
+	}
+	return IsContractVersionAtLeast(n.Properties.Internal["ver"], 2, 11) && !IsVaultAutoOptInLockedForSender(n, types.ZeroAddress.String())
+}
+
+// nfdEnabled returns true if there's an NFD API to use - there may not be on localnet or custom networks
+func nfdEnabled() bool {
+	return api != nil
+}
+
+// checkNfdFeatures makes sure nothing configured needs the NFD API when there isn't one - without it, recipients
+// can only come from a csv file of accounts, sent to directly.
+func checkNfdFeatures(config *BatchSendConfig, vault string) error {
+	if nfdEnabled() {
+		return nil
+	}
+	var needsNfd []string
+	if vault != "" {
+		needsNfd = append(needsNfd, "sending from a vault (-vault)")
+	}
+	if config.Destination.CsvFile == "" && config.Destination.HolderSnapshot == nil {
+		needsNfd = append(needsNfd, "recipients other than a csv file of accounts or a holder snapshot")
+	}
+	if config.Destination.SendToVaults {
+		needsNfd = append(needsNfd, "sendToVaults")
+	}
+	if config.Destination.NotOptedIn == NotOptedInVault {
+		needsNfd = append(needsNfd, "notOptedIn of vault")
+	}
+	if len(config.Destination.VerifiedRequirements) > 0 {
+		needsNfd = append(needsNfd, "verifiedRequirements")
+	}
+	if config.Distribution.Strategy == DistributeBySegmentCount {
+		needsNfd = append(needsNfd, "the bySegmentCount distribution")
+	}
+	if len(needsNfd) > 0 {
+		return fmt.Errorf("no NFD API configured (-nfdapi or ALGO_NFD_URL) but it's needed for: %s", strings.Join(needsNfd, ", "))
+	}
+	return nil
+}
+
+// retryNfdApiCalls makes the NFD API call (through the shared NFD API throttle), retrying it if rate limited -
+// pausing all NFD API calls for as long as the API asks.
 func retryNfdApiCalls(meth func() error) error {
 	return repeat.Repeat(
 		repeat.Fn(func() error {
+			if err := nfdThrottle.wait(); err != nil {
+				return repeat.HintStop(err)
+			}
+			nfdThrottle.acquire()
 			err := meth()
+			nfdThrottle.release()
 			if err != nil {
 				if rate, match := isRateLimited(err); match {
 					logger.Warn("rate limited", "waiting", rate.SecsRemaining)
-					time.Sleep(time.Duration(rate.SecsRemaining+1) * time.Second)
+					nfdThrottle.rateLimited(time.Duration(rate.SecsRemaining+1) * time.Second)
 					return repeat.HintTemporary(err)
 				}
 				var swaggerError nfdapi.GenericSwaggerError
@@ -94,13 +146,66 @@ func retryNfdApiCalls(meth func() error) error {
 						return fmt.Errorf("message:%s, err:%w", moderr.Message, err)
 					}
 				}
+				return err
 			}
-			return err
+			nfdThrottle.succeeded()
+			return nil
 		}),
 		repeat.StopOnSuccess(),
 	)
 }
 
+// applySearchFilters sets the configured search filters (if any) on the NFD search
+func applySearchFilters(search *NfdSearchChoice, searchOpts *nfdapi.NfdApiNfdSearchV2Opts) error {
+	if search == nil {
+		return nil
+	}
+	if search.Category != "" {
+		searchOpts.Category = optional.NewInterface(search.Category)
+	}
+	if search.Length != "" {
+		searchOpts.Length = optional.NewInterface(search.Length)
+	}
+	if search.Traits != "" {
+		if searchOpts.Traits.IsSet() {
+			return errors.New("search traits can't be combined with onlyRoots")
+		}
+		searchOpts.Traits = optional.NewInterface(search.Traits)
+	}
+	if search.Prefix != "" {
+		searchOpts.Prefix = optional.NewString(search.Prefix)
+	}
+	if search.Substring != "" {
+		searchOpts.Substring = optional.NewString(search.Substring)
+	}
+	if search.VProperty != "" {
+		searchOpts.Vproperty = optional.NewString(search.VProperty)
+	}
+	if search.VValue != "" {
+		if search.VProperty == "" {
+			return errors.New("search vvalue requires a vproperty")
+		}
+		searchOpts.Vvalue = optional.NewString(search.VValue)
+	}
+	if search.SegmentLocked != nil {
+		searchOpts.SegmentLocked = optional.NewBool(*search.SegmentLocked)
+	}
+	if search.SegmentRoot != nil {
+		searchOpts.SegmentRoot = optional.NewBool(*search.SegmentRoot)
+	}
+	// changedAfter is filtered on once fetched (see searchChangedAfter) - the generated client doesn't format times
+	// the way the API expects
+	return nil
+}
+
+// searchChangedAfter returns the time NFDs have to have changed after to be included - zero if not filtering on it
+func searchChangedAfter(search *NfdSearchChoice) (time.Time, error) {
+	if search == nil || search.ChangedAfter == "" {
+		return time.Time{}, nil
+	}
+	return search.changedAfter()
+}
+
 func getAllNfds(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 	var (
 		offset, limit int64 = 0, 200
@@ -109,6 +214,11 @@ func getAllNfds(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 		nfds          []*nfdapi.NfdRecord
 	)
 
+	changedAfter, err := searchChangedAfter(config.Destination.Search)
+	if err != nil {
+		return nil, err
+	}
+
 	for ; ; offset += limit {
 		view := "brief"
 		if len(config.Destination.VerifiedRequirements) > 0 {
@@ -124,6 +234,9 @@ func getAllNfds(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 			if config.Destination.OnlyRoots {
 				searchOpts.Traits = optional.NewInterface("pristine")
 			}
+			if err := applySearchFilters(config.Destination.Search, searchOpts); err != nil {
+				return repeat.HintStop(err)
+			}
 			fetchedNfds, _, err = api.NfdApi.NfdSearchV2(ctx, searchOpts)
 			return err
 		})
@@ -139,6 +252,9 @@ func getAllNfds(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 			if nfd.DepositAccount == "" {
 				continue
 			}
+			if !changedAfter.IsZero() && nfd.TimeChanged.Before(changedAfter) {
+				continue
+			}
 			newRecord := nfd
 			nfds = append(nfds, &newRecord)
 		}
@@ -152,7 +268,7 @@ func getSegmentsOfRoot(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	misc.Infof(logger, fmt.Sprintf("nfd app id for %s is:%v", nfd.Name, nfd.AppID))
+	misc.Infof(logger, "nfd app id for %s is:%v", nfd.Name, nfd.AppID)
 
 	nfds, err := getAllSegments(ctx, config, nfd.AppID)
 	if err != nil {
@@ -170,19 +286,28 @@ func getAllSegments(ctx context.Context, config *BatchSendConfig, parentAppID in
 		nfds          []*nfdapi.NfdRecord
 	)
 
+	changedAfter, err := searchChangedAfter(config.Destination.Search)
+	if err != nil {
+		return nil, err
+	}
+
 	for ; ; offset += limit {
 		view := "brief"
 		if len(config.Destination.VerifiedRequirements) > 0 {
 			view = "full"
 		}
 		err = retryNfdApiCalls(func() error {
-			records, _, err = api.NfdApi.NfdSearchV2(ctx, &nfdapi.NfdApiNfdSearchV2Opts{
+			searchOpts := &nfdapi.NfdApiNfdSearchV2Opts{
 				ParentAppID: optional.NewInt64(parentAppID),
 				State:       optional.NewInterface("owned"),
 				View:        optional.NewString(view),
 				Limit:       optional.NewInt64(limit),
 				Offset:      optional.NewInt64(offset),
-			})
+			}
+			if err := applySearchFilters(config.Destination.Search, searchOpts); err != nil {
+				return repeat.HintStop(err)
+			}
+			records, _, err = api.NfdApi.NfdSearchV2(ctx, searchOpts)
 			return err
 		})
 
@@ -197,6 +322,9 @@ func getAllSegments(ctx context.Context, config *BatchSendConfig, parentAppID in
 			if record.DepositAccount == "" {
 				continue
 			}
+			if !changedAfter.IsZero() && record.TimeChanged.Before(changedAfter) {
+				continue
+			}
 			newRecord := record
 			nfds = append(nfds, &newRecord)
 		}
@@ -212,6 +340,7 @@ func getAssetSendTxns(
 	assetID uint64,
 	amount uint64,
 	note string,
+	lease [32]byte,
 	params types.SuggestedParams,
 ) (string, []byte, error) {
 	var (
@@ -220,10 +349,10 @@ func getAssetSendTxns(
 	)
 
 	if sendFromVaultName == "" && recipientIsVault == false {
-		// Not sending from vault, nor sending to a vault - so just plain asset transfer
-		txn, err := transaction.MakeAssetTransferTxn(sender, recipient, amount, []byte(note), params, "", assetID)
+		// Not sending from vault, nor sending to a vault - so just plain asset transfer (or payment if ALGO)
+		txn, err := makeDirectSendTxn(sender, recipient, assetID, amount, note, lease, params)
 		if err != nil {
-			return "", nil, fmt.Errorf("MakeAssetTransferTxn fail: %w", err)
+			return "", nil, err
 		}
 		txnid, signedBytes, err := signer.SignWithAccount(ctx, txn, sender)
 		return txnid, signedBytes, err
@@ -267,7 +396,7 @@ func getAssetSendTxns(
 	})
 
 	if err != nil {
-		return "", nil, fmt.Errorf("error in NfdSendToVault call: %w", err)
+		return "", nil, fmt.Errorf(nfdApiErrorPrefix+": %w", err)
 	}
 	return algo.DecodeAndSignNFDTransactions(encodedTxns, signer)
 }
@@ -278,12 +407,18 @@ func isRateLimited(err error) (*nfdapi.RateLimited, bool) {
 			return &limit, true
 		}
 		if strings.Contains(string(swaggerError.Body()), "429 Too Many Requests") {
-			return &nfdapi.RateLimited{0, 0}, true
+			return &nfdapi.RateLimited{}, true
 		}
 	}
 	return nil, false
 }
 
+// isNfdNotFound returns true if the NFD API call failed because nothing was found
+func isNfdNotFound(err error) bool {
+	swaggerError, match := isSwaggerError(err)
+	return match && strings.HasPrefix(swaggerError.Error(), "404")
+}
+
 func isSwaggerError(err error) (*nfdapi.GenericSwaggerError, bool) {
 	var swaggerError nfdapi.GenericSwaggerError
 	if errors.As(err, &swaggerError) {
@@ -291,3 +426,31 @@ func isSwaggerError(err error) (*nfdapi.GenericSwaggerError, bool) {
 	}
 	return nil, false
 }
+
+// makeDirectSendTxn builds the (unsigned) plain asset transfer - or payment if ALGO - for a send that doesn't
+// involve a vault on either side.
+func makeDirectSendTxn(sender string, recipient string, assetID uint64, amount uint64, note string, lease [32]byte, params types.SuggestedParams) (types.Transaction, error) {
+	var (
+		txn types.Transaction
+		err error
+	)
+	if assetID == AlgoAssetID {
+		txn, err = transaction.MakePaymentTxn(sender, recipient, amount, []byte(note), "", params)
+		if err != nil {
+			return types.Transaction{}, fmt.Errorf("MakePaymentTxn fail: %w", err)
+		}
+	} else {
+		txn, err = transaction.MakeAssetTransferTxn(sender, recipient, amount, []byte(note), params, "", assetID)
+		if err != nil {
+			return types.Transaction{}, fmt.Errorf("MakeAssetTransferTxn fail: %w", err)
+		}
+	}
+	// lease is only possible on txns we build ourselves - the NFD API builds the vault txns.  A per byte fee was
+	// computed without the lease, so it has to go up by the bytes the lease adds.
+	if params.FlatFee {
+		txn.AddLeaseWithFlatFee(lease, uint64(params.Fee))
+	} else {
+		txn.AddLease(lease, uint64(params.Fee))
+	}
+	return txn, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+const defaultNftAssignmentFile = "nft-assignments.csv"
+
+// fetchNftPool builds the pool of NFTs to distribute - either from the explicit list of ASAs or from the assets
+// created by the configured creator account.  Only NFTs the source account actually holds are kept, and each
+// will be sent in its entirety (our full holding) to a single recipient.
+func fetchNftPool(config *BatchSendConfig) ([]*SendAsset, error) {
+	nftConfig := config.Send.Nfts
+	if nftConfig.Creator != "" && len(nftConfig.ASAs) > 0 {
+		return nil, errors.New("nfts: specify either asas or creator, not both")
+	}
+	assetIds := nftConfig.ASAs
+	if nftConfig.Creator != "" {
+		creatorInfo, err := algoClient.AccountInformation(nftConfig.Creator).Do(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching created assets of creator:%s, err:%w", nftConfig.Creator, err)
+		}
+		for _, created := range creatorInfo.CreatedAssets {
+			if created.Deleted {
+				continue
+			}
+			assetIds = append(assetIds, created.Index)
+		}
+		slices.Sort(assetIds)
+		misc.Infof(logger, "..creator %s has created %d assets", nftConfig.Creator, len(assetIds))
+	}
+	if len(assetIds) == 0 {
+		return nil, errors.New("nfts: no NFTs specified to distribute")
+	}
+
+	var (
+		pool    []*SendAsset
+		seen    = map[uint64]bool{}
+		notHeld int
+		notNfts int
+	)
+	for _, assetId := range assetIds {
+		if seen[assetId] {
+			return nil, fmt.Errorf("nfts: ASA:%d is specified more than once", assetId)
+		}
+		seen[assetId] = true
+		assetInfo, err := algoClient.GetAssetByID(assetId).Do(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching asset info for ASA:%d, err:%w", assetId, err)
+		}
+		if !isNft(assetInfo.Params) {
+			if nftConfig.Creator == "" {
+				return nil, fmt.Errorf("nfts: ASA:%d (%s) isn't an NFT - total:%d, decimals:%d", assetId, assetInfo.Params.UnitName, assetInfo.Params.Total, assetInfo.Params.Decimals)
+			}
+			// other (fungible) assets of the creator
+			notNfts++
+			continue
+		}
+		holdingInfo, err := algoClient.AccountAssetInformation(sourceAccount.String(), assetId).Do(ctx)
+		if err != nil && !isAlgoNotFound(err) {
+			return nil, fmt.Errorf("error fetching holding of ASA:%d for account:%s, err:%w", assetId, sourceAccount.String(), err)
+		}
+		if err != nil || holdingInfo.AssetHolding.Amount == 0 {
+			// not opted-in, or nothing to send
+			notHeld++
+			continue
+		}
+		pool = append(pool, &SendAsset{
+			AssetID:          assetId,
+			AssetParams:      assetInfo.Params,
+			ExistingBalance:  holdingInfo.AssetHolding.Amount,
+			IsAmountPerRecip: true,
+			Note:             nftConfig.Note,
+		})
+	}
+	if notNfts > 0 {
+		misc.Infof(logger, "..skipped %d assets of creator %s that aren't NFTs", notNfts, nftConfig.Creator)
+	}
+	if notHeld > 0 {
+		misc.Infof(logger, "..skipped %d NFTs not held by %s", notHeld, sourceAccount.String())
+	}
+	return pool, nil
+}
+
+// isNft returns true if the asset is an NFT - a single unit (total of 1, no decimals), or a fractional NFT whose
+// total is exactly 1 whole unit (10^decimals).
+func isNft(params models.AssetParams) bool {
+	wholeUnit := uint64(1)
+	for range params.Decimals {
+		wholeUnit *= 10
+	}
+	return params.Total == wholeUnit
+}
+
+// assignNfts gives each recipient exactly one distinct NFT from the pool, setting Recipient.NftAssetID.
+// Assignments from a prior run (read from the assignment file) are kept as-is, and NFTs assigned to recipients
+// not part of this run stay reserved for them.  The combined assignments are written back to the assignment file
+// so a re-run produces the same result.  Recipients whose assigned NFT is no longer held are left out of the returned
+// recipients once confirmed as sent it by a prior run (see nftDelivered) - if that can't be confirmed, it's an error
+// as the NFT may have gone elsewhere.
+func assignNfts(config *BatchSendConfig, recipients []*Recipient, pool []*SendAsset) ([]*Recipient, error) {
+	var (
+		nftConfig      = config.Send.Nfts
+		assignmentFile = nftConfig.AssignmentFile
+		poolIds        = map[uint64]bool{}
+		used           = map[uint64]bool{}
+		kept           []*Recipient
+		unassigned     []*Recipient
+		toConfirm      []*Recipient
+		delivered      int
+	)
+	for _, nft := range pool {
+		poolIds[nft.AssetID] = true
+	}
+	prior, err := loadNftAssignments(assignmentFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(prior) > 0 {
+		misc.Infof(logger, "..loaded %d prior NFT assignments from %s", len(prior), assignmentFile)
+	}
+	for _, assetId := range prior {
+		used[assetId] = true
+	}
+	for _, recipient := range recipients {
+		if assetId, found := prior[recipient.Key()]; found {
+			if !poolIds[assetId] {
+				toConfirm = append(toConfirm, recipient)
+				continue
+			}
+			recipient.NftAssetID = assetId
+			kept = append(kept, recipient)
+			continue
+		}
+		kept = append(kept, recipient)
+		unassigned = append(unassigned, recipient)
+	}
+
+	if len(toConfirm) > 0 {
+		misc.Infof(logger, "..confirming delivery of %d assigned NFTs no longer held", len(toConfirm))
+	}
+	for _, recipient := range toConfirm {
+		assetId := prior[recipient.Key()]
+		isDelivered, err := nftDelivered(recipient, assetId)
+		if err != nil {
+			return nil, err
+		}
+		if !isDelivered {
+			return nil, fmt.Errorf("ASA:%d assigned to %s is no longer held, but can't be confirmed as sent to them - check where it went (and fix %s) before sending", assetId, recipient.NfdName, assignmentFile)
+		}
+		misc.Infof(logger, "..skipping %s - its assigned ASA:%d was sent by a prior run", recipient.NfdName, assetId)
+		delivered++
+	}
+
+	var available []uint64
+	for _, nft := range pool {
+		if !used[nft.AssetID] {
+			available = append(available, nft.AssetID)
+		}
+	}
+	if len(available) < len(unassigned) {
+		return nil, fmt.Errorf("only %d NFTs available to assign to %d recipients - limit recipients with randomNFDs.count", len(available), len(unassigned))
+	}
+	switch nftConfig.Assignment {
+	case "", "random":
+		rand.Shuffle(len(available), func(i, j int) {
+			available[i], available[j] = available[j], available[i]
+		})
+	case "ordered":
+	default:
+		return nil, fmt.Errorf("unknown nft assignment type:%s, must be random or ordered", nftConfig.Assignment)
+	}
+	for i, recipient := range unassigned {
+		recipient.NftAssetID = available[i]
+		prior[recipient.Key()] = available[i]
+	}
+	misc.Infof(logger, "..assigned %d new NFTs (%d kept from prior assignments, %d already sent)", len(unassigned), len(kept)-len(unassigned), delivered)
+	if err := saveNftAssignments(assignmentFile, prior); err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// nftDelivered returns true if the NFT was sent to the recipient - it's held by their deposit account (or vault), or
+// the indexer (if there is one) finds it transferred to them (they may have since sent it on).
+func nftDelivered(recipient *Recipient, assetId uint64) (bool, error) {
+	accounts := []string{recipient.DepositAccount}
+	if recipient.VaultAccount != "" && recipient.VaultAccount != recipient.DepositAccount {
+		accounts = append(accounts, recipient.VaultAccount)
+	}
+	for _, account := range accounts {
+		var (
+			holdingInfo models.AccountAssetResponse
+			err         error
+		)
+		err = retryAlgoCalls(func() error {
+			holdingInfo, err = algoClient.AccountAssetInformation(account, assetId).Do(ctx)
+			return err
+		})
+		if err != nil && !isAlgoNotFound(err) {
+			return false, fmt.Errorf("error fetching holding of ASA:%d for account:%s, err:%w", assetId, account, err)
+		}
+		if err == nil && holdingInfo.AssetHolding.Amount > 0 {
+			return true, nil
+		}
+	}
+	if indexerClient == nil {
+		return false, nil
+	}
+	for _, account := range accounts {
+		var (
+			resp models.TransactionsResponse
+			err  error
+		)
+		err = retryAlgoCalls(func() error {
+			resp, err = indexerClient.LookupAssetTransactions(assetId).AddressString(account).AddressRole("receiver").
+				CurrencyGreaterThan(0).Limit(1).Do(ctx)
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("error looking up transfers of ASA:%d to account:%s, err:%w", assetId, account, err)
+		}
+		if len(resp.Transactions) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func loadNftAssignments(filename string) (map[string]uint64, error) {
+	assignments := map[string]uint64{}
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return assignments, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading nft assignments from %s: %w", filename, err)
+	}
+	for i, row := range records {
+		if i == 0 || len(row) != 2 {
+			// skip header
+			continue
+		}
+		assetId, err := strconv.ParseUint(row[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid asa:%s in nft assignments file %s", row[1], filename)
+		}
+		assignments[row[0]] = assetId
+	}
+	return assignments, nil
+}
+
+func saveNftAssignments(filename string, assignments map[string]uint64) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keys := make([]string, 0, len(assignments))
+	for key := range assignments {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"recipient", "asa"})
+	for _, key := range keys {
+		writer.Write([]string{key, strconv.FormatUint(assignments[key], 10)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error saving nft assignments to %s: %w", filename, err)
+	}
+	misc.Infof(logger, "Saved NFT assignments to %s", filename)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mailgun/holster/v4/syncutil"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+// checkOptIns verifies every send direct to a recipient's account is to an account opted-in to the asset - ALGO
+// and vault sends need no opt-in.  Sends to recipients not opted-in are handled according to the notOptedIn policy:
+// dropped (and reported), redirected to the recipient's NFD vault, or stopping the run.  The dropped sends are
+// returned as well, so a total can be shared again without them.  optedIn holds the accounts already checked (by
+// optInKey) and is added to, so planning again doesn't check them again.
+func checkOptIns(policy string, plan []*PlannedSend, optedIn map[string]bool) ([]*PlannedSend, []*PlannedSend, error) {
+	switch policy {
+	case "":
+		policy = NotOptedInSkip
+	case NotOptedInSkip, NotOptedInVault, NotOptedInFail:
+	default:
+		return nil, nil, fmt.Errorf("unknown notOptedIn policy:%s, must be skip, vault, or fail", policy)
+	}
+
+	var (
+		fanOut   = syncutil.NewFanOut(maxSimultaneousSends)
+		mu       sync.Mutex
+		toCheck  []*PlannedSend
+		newPlan  = make([]*PlannedSend, 0, len(plan))
+		skipped  []*PlannedSend
+		toVaults int
+	)
+	for _, send := range plan {
+		if send.recipient.SendToVault || send.asset.AssetID == AlgoAssetID {
+			continue
+		}
+		if _, checked := optedIn[optInKey(send)]; !checked {
+			toCheck = append(toCheck, send)
+		}
+	}
+	if len(toCheck) > 0 {
+		misc.Infof(logger, "..checking asset opt-ins of %d sends", len(toCheck))
+	}
+	for _, send := range toCheck {
+		fanOut.Run(func(val any) error {
+			send := val.(*PlannedSend)
+			err := retryAlgoCalls(func() error {
+				_, err := algoClient.AccountAssetInformation(send.recipient.DepositAccount, send.asset.AssetID).Do(ctx)
+				return err
+			})
+			if err != nil && !isAlgoNotFound(err) {
+				return fmt.Errorf("error checking opt-in of ASA:%d for account:%s, err:%w", send.asset.AssetID, send.recipient.DepositAccount, err)
+			}
+			mu.Lock()
+			optedIn[optInKey(send)] = err == nil
+			mu.Unlock()
+			return nil
+		}, send)
+	}
+	if errs := fanOut.Wait(); len(errs) > 0 {
+		return nil, nil, errs[0]
+	}
+
+	for _, send := range plan {
+		if isOptedIn, checked := optedIn[optInKey(send)]; !checked || isOptedIn {
+			newPlan = append(newPlan, send)
+			continue
+		}
+		switch {
+		case policy == NotOptedInFail:
+			return nil, nil, fmt.Errorf("recipient %s (%s) is not opted-in to ASA:%d", send.recipient.NfdName, send.recipient.DepositAccount, send.asset.AssetID)
+		case policy == NotOptedInVault && send.recipient.VaultAccount != "":
+			// send to their vault instead - just this send, they may be opted-in to other assets
+			vaultRecipient := *send.recipient
+			vaultRecipient.DepositAccount = vaultRecipient.VaultAccount
+			vaultRecipient.SendToVault = true
+			newPlan = append(newPlan, &PlannedSend{asset: send.asset, recipient: &vaultRecipient, amount: send.amount})
+			toVaults++
+		default:
+			misc.Infof(logger, "..skipping %s (%s) - not opted-in to ASA:%d", send.recipient.NfdName, send.recipient.DepositAccount, send.asset.AssetID)
+			skipped = append(skipped, send)
+		}
+	}
+	if toVaults > 0 {
+		misc.Infof(logger, "..%d sends to recipients not opted-in will go to their NFD vault instead", toVaults)
+	}
+	if len(skipped) > 0 {
+		misc.Infof(logger, "..skipped %d sends to recipients not opted-in", len(skipped))
+	}
+	return newPlan, skipped, nil
+}
+
+func optInKey(send *PlannedSend) string {
+	return recipientOptInKey(send.recipient, send.asset.AssetID)
+}
+
+func recipientOptInKey(recipient *Recipient, assetID uint64) string {
+	return fmt.Sprintf("%s/%d", recipient.DepositAccount, assetID)
+}
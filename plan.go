@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+// PlannedSend is a single send of an amount of one asset to one recipient.  The full list of planned sends is
+// determined up front so balances can be verified against exactly what will be sent.
+type PlannedSend struct {
+	asset     *SendAsset
+	recipient *Recipient
+	amount    uint64 // in base units
+}
+
+// planSends determines what is sent to each recipient.  For fungible assets, each recipient receives the configured
+// amount (per recipient, or its share of the total) unless the recipient has its own amount (from the csv file).
+// When sending a total, recipients with their own amounts are taken out of the total first and the remainder is
+// shared across everyone else according to the distribution strategy.  For NFTs, each recipient receives the NFT
+// assigned to it.  Sends in excluded (by optInKey - ie: to recipients not opted-in) are left out, so the total is
+// shared by the rest.
+func planSends(assets []*SendAsset, recipients []*Recipient, excluded map[string]bool) ([]*PlannedSend, error) {
+	var plan []*PlannedSend
+	if sendConfig.Send.Nfts != nil {
+		// Each recipient gets the NFT assigned to it - sending our entire holding of that NFT
+		nftsByID := make(map[uint64]*SendAsset, len(assets))
+		for _, asset := range assets {
+			nftsByID[asset.AssetID] = asset
+		}
+		for _, recipient := range recipients {
+			nft, found := nftsByID[recipient.NftAssetID]
+			if !found {
+				return nil, fmt.Errorf("recipient %s has no NFT assigned", recipient.NfdName)
+			}
+			if excluded[recipientOptInKey(recipient, nft.AssetID)] {
+				continue
+			}
+			plan = append(plan, &PlannedSend{asset: nft, recipient: recipient, amount: nft.ExistingBalance})
+		}
+		misc.Infof(logger, "Sending %d unique NFTs to %d recipients", len(plan), len(recipients))
+		return plan, nil
+	}
+
+	equalWeighting := sendConfig.Distribution.Strategy == "" || sendConfig.Distribution.Strategy == DistributeEqual
+	for _, asset := range assets {
+		var (
+			amounts       = make([]uint64, len(recipients))
+			shareIndices  []int
+			shareWeights  []float64
+			overrideTotal uint64
+			assetTotal    uint64
+			numOverridden int
+			numExcluded   int
+			skipped       int
+		)
+		for i, recipient := range recipients {
+			if excluded[recipientOptInKey(recipient, asset.AssetID)] {
+				numExcluded++
+				continue
+			}
+			if override, found := recipient.AmountOverride.forAsset(asset.AssetID); found {
+				baseUnits, err := asset.amountInBaseUnits(override)
+				if err != nil {
+					return nil, fmt.Errorf("amount for recipient %s: %w", recipient.NfdName, err)
+				}
+				amounts[i] = baseUnits
+				overrideTotal += amounts[i]
+				numOverridden++
+			} else if asset.IsAmountPerRecip {
+				amounts[i] = asset.AmountToSend
+			} else {
+				shareIndices = append(shareIndices, i)
+				if equalWeighting {
+					shareWeights = append(shareWeights, 1)
+				} else {
+					shareWeights = append(shareWeights, recipient.Weight)
+				}
+			}
+		}
+		if !asset.IsAmountPerRecip {
+			// Amounts given explicitly to recipients come out of the total first, the rest is shared by weight
+			total := asset.AmountToSend
+			if overrideTotal > total {
+				return nil, fmt.Errorf("amounts specified per recipient for asset %d exceed total amount to send:%s", asset.AssetID, asset.formattedAmount(total))
+			}
+			if len(shareIndices) == 0 {
+				// every recipient has its own amount - there's no one to share the rest with
+				if remainder := total - overrideTotal; remainder > 0 {
+					misc.Infof(logger, "..every recipient of asset %d has its own amount - %s of the total is left undistributed",
+						asset.AssetID, asset.formattedAmount(remainder))
+				}
+			} else {
+				shares, err := apportion(total-overrideTotal, shareWeights)
+				if err != nil {
+					return nil, fmt.Errorf("unable to distribute asset %d: %w", asset.AssetID, err)
+				}
+				for i, share := range shares {
+					amounts[shareIndices[i]] = share
+				}
+			}
+		}
+		for i, recipient := range recipients {
+			if excluded[recipientOptInKey(recipient, asset.AssetID)] {
+				continue
+			}
+			if amounts[i] == 0 {
+				skipped++
+				continue
+			}
+			assetTotal += amounts[i]
+			plan = append(plan, &PlannedSend{asset: asset, recipient: recipient, amount: amounts[i]})
+		}
+		misc.Infof(logger, "Sending a total of %s of asset %d to %d recipients (distribution:%s, %d with their own amounts)",
+			asset.formattedAmount(assetTotal), asset.AssetID, len(recipients)-numExcluded-skipped, sendConfig.Distribution.String(), numOverridden)
+		if skipped > 0 {
+			misc.Infof(logger, "..skipping %d recipients of asset %d whose amount is 0", skipped, asset.AssetID)
+		}
+	}
+	return plan, nil
+}
+
+// plannedTotals returns the total base units to be sent of each asset
+func plannedTotals(plan []*PlannedSend) map[uint64]uint64 {
+	totals := map[uint64]uint64{}
+	for _, send := range plan {
+		totals[send.asset.AssetID] += send.amount
+	}
+	return totals
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+	nfdapi "github.com/TxnLab/batch-asset-send/lib/nfdapi/swagger"
+)
+
+// RecipientListChoice is a list of recipients (for the include and exclude lists of the destination) - by account,
+// NFD name, or root (the root and all its segments), given inline and/or in files.
+type RecipientListChoice struct {
+	Accounts []string `json:"accounts,omitempty"`
+	Nfds     []string `json:"nfds,omitempty"`
+	Roots    []string `json:"roots,omitempty"`
+	// Files of one account, NFD name, or root (as *.root.algo) per line - blank lines and # comments are ignored
+	Files []string `json:"files,omitempty"`
+}
+
+func (rc RecipientListChoice) String() string {
+	var parts []string
+	add := func(count int, kind string) {
+		if count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, kind))
+		}
+	}
+	add(len(rc.Accounts), "accounts")
+	add(len(rc.Nfds), "nfds")
+	add(len(rc.Roots), "roots")
+	add(len(rc.Files), "files")
+	return strings.Join(parts, ", ")
+}
+
+// recipientList is a loaded RecipientListChoice, for matching NFDs against
+type recipientList struct {
+	accounts map[string]bool
+	nfds     map[string]bool
+	roots    []string
+}
+
+// loadRecipientList loads the inline entries and the files of the list
+func loadRecipientList(choice *RecipientListChoice) (*recipientList, error) {
+	list := &recipientList{accounts: map[string]bool{}, nfds: map[string]bool{}}
+	for _, account := range choice.Accounts {
+		if err := list.add(account); err != nil {
+			return nil, err
+		}
+	}
+	for _, nfd := range choice.Nfds {
+		list.nfds[strings.ToLower(strings.TrimSpace(nfd))] = true
+	}
+	for _, root := range choice.Roots {
+		list.roots = append(list.roots, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(root), "*.")))
+	}
+	for _, filename := range choice.Files {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error opening recipient list file: %w", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for lineNum := 1; scanner.Scan(); lineNum++ {
+			if err := list.add(scanner.Text()); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s line %d: %w", filename, lineNum, err)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading recipient list file %s: %w", filename, err)
+		}
+	}
+	return list, nil
+}
+
+// add adds an entry of unknown type - an account, *.root.algo for a root, or otherwise an NFD name
+func (rl *recipientList) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	switch {
+	case entry == "" || strings.HasPrefix(entry, "#"):
+	case strings.HasPrefix(entry, "*."):
+		rl.roots = append(rl.roots, strings.ToLower(strings.TrimPrefix(entry, "*.")))
+	case strings.HasSuffix(strings.ToLower(entry), ".algo"):
+		rl.nfds[strings.ToLower(entry)] = true
+	default:
+		if _, err := types.DecodeAddress(entry); err != nil {
+			return fmt.Errorf("%s isn't an account or NFD name", entry)
+		}
+		rl.accounts[entry] = true
+	}
+	return nil
+}
+
+// matches returns true if the NFD is in the list - by any of its accounts (owner, deposit, NFD, or verified
+// caAlgo accounts), its name, or being a root (or segment of a root) in the list.
+func (rl *recipientList) matches(nfd *nfdapi.NfdRecord) bool {
+	for _, account := range append([]string{nfd.Owner, nfd.DepositAccount, nfd.NfdAccount}, nfd.CaAlgo...) {
+		if account != "" && rl.accounts[account] {
+			return true
+		}
+	}
+	name := strings.ToLower(nfd.Name)
+	if rl.nfds[name] {
+		return true
+	}
+	for _, root := range rl.roots {
+		if name == root || strings.HasSuffix(name, "."+root) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRecipientLists keeps only the NFDs in the include list (if there is one), then removes those in the
+// exclude list - reporting how many each removed.
+func applyRecipientLists(config *BatchSendConfig, records []*nfdapi.NfdRecord) ([]*nfdapi.NfdRecord, error) {
+	filter := func(choice *RecipientListChoice, listName string, keep bool) error {
+		if choice == nil {
+			return nil
+		}
+		list, err := loadRecipientList(choice)
+		if err != nil {
+			return fmt.Errorf("error loading %s list: %w", listName, err)
+		}
+		filteredRecords := make([]*nfdapi.NfdRecord, 0, len(records))
+		for _, nfd := range records {
+			if list.matches(nfd) == keep {
+				filteredRecords = append(filteredRecords, nfd)
+			}
+		}
+		misc.Infof(logger, "..%s list removed %d of %d recipients", listName, len(records)-len(filteredRecords), len(records))
+		records = filteredRecords
+		return nil
+	}
+	if err := filter(config.Destination.Include, "include", true); err != nil {
+		return nil, err
+	}
+	if err := filter(config.Destination.Exclude, "exclude", false); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
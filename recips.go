@@ -5,17 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/algorand/go-algorand-sdk/v2/types"
 	"github.com/antihax/optional"
 	"github.com/mailgun/holster/v4/syncutil"
-	"github.com/ssgreg/repeat"
-	"golang.org/x/time/rate"
 
 	"github.com/TxnLab/batch-asset-send/lib/misc"
 	nfdapi "github.com/TxnLab/batch-asset-send/lib/nfdapi/swagger"
@@ -27,30 +26,113 @@ type Recipient struct {
 	OwnerAccount   string
 	DepositAccount string
 	SendToVault    bool
+	// NFT distribution mode only - the specific NFT assigned to this recipient
+	NftAssetID uint64
+	// Amounts for this recipient specified in the csv file (if any) - overriding the configured amount
+	AmountOverride *AmountOverride
+	// AppID of the recipient NFD (0 for account-only recipients)
+	AppID int64
+	// VaultAccount is the NFD vault this recipient can be sent to instead of its deposit account, if it's able to
+	// receive (contract 2.11+ and not locked).  Only set when not already sending to vaults.
+	VaultAccount string
+	// Relative share of a total amount this recipient receives - see DistributionChoice
+	Weight float64
+}
+
+// csvRowValues are the optional per-row values from the csv file, applied to the recipient for that row
+type csvRowValues struct {
+	amounts *AmountOverride
+	weight  *float64
+}
+
+// AmountOverride holds per-recipient amounts (in display units) loaded from the csv file.  Amount ('amount' column)
+// applies to every asset being sent, AssetAmounts ('amount_<asa>' columns) to just that asset.
+type AmountOverride struct {
+	Amount       *Amount
+	AssetAmounts map[uint64]Amount
+}
+
+// forAsset returns the amount override for the specified asset, if there is one.
+func (ao *AmountOverride) forAsset(assetID uint64) (Amount, bool) {
+	if ao == nil {
+		return Amount{}, false
+	}
+	if amount, found := ao.AssetAmounts[assetID]; found {
+		return amount, true
+	}
+	if ao.Amount != nil {
+		return *ao.Amount, true
+	}
+	return Amount{}, false
+}
+
+// add combines the amounts of other into this override - used when recipients are merged into one
+func (ao *AmountOverride) add(other *AmountOverride) {
+	if other.Amount != nil {
+		amount := *other.Amount
+		if ao.Amount != nil {
+			amount = amount.Add(*ao.Amount)
+		}
+		ao.Amount = &amount
+	}
+	for assetID, amount := range other.AssetAmounts {
+		if ao.AssetAmounts == nil {
+			ao.AssetAmounts = map[uint64]Amount{}
+		}
+		ao.AssetAmounts[assetID] = ao.AssetAmounts[assetID].Add(amount)
+	}
+}
+
+// Key uniquely identifies a recipient across runs - used for persisting per-recipient state.
+func (r *Recipient) Key() string {
+	return r.NfdName + "/" + r.DepositAccount
 }
 
 // collectRecipients collects recipients based on the given configuration and sendingFromVault record.
 // If the number of recipients to pick is 0 or more than the number of available NFDs, it returns recipients from all NFDs.
 // Otherwise, it returns recipients from randomly selected NFDs.
 func collectRecipients(config *BatchSendConfig, sendingFromVault *nfdapi.NfdRecord) ([]*Recipient, error) {
-	nfdsToChooseFrom, err := getNfdsToChooseFrom(config)
+	nfdsToChooseFrom, csvValues, err := getNfdsToChooseFrom(config)
 	if err != nil {
 		return nil, err
 	}
 
 	numToPick := getNumToPick(config, nfdsToChooseFrom)
 
+	var recipients []*Recipient
 	if numToPick == 0 || len(nfdsToChooseFrom) <= numToPick {
-		return getRecipientsFromAllNFds(config, nfdsToChooseFrom, sendingFromVault), nil
+		recipients = getRecipientsFromAllNFds(config, nfdsToChooseFrom, sendingFromVault)
+	} else {
+		recipients = getRecipientsFromRandomNFds(numToPick, config, nfdsToChooseFrom, sendingFromVault)
 	}
-
-	return getRecipientsFromRandomNFds(numToPick, config, nfdsToChooseFrom, sendingFromVault), nil
+	for _, recipient := range recipients {
+		if rowValues, found := csvValues[recipient.NfdName]; found {
+			recipient.AmountOverride = rowValues.amounts
+			if rowValues.weight != nil {
+				recipient.Weight = *rowValues.weight
+			}
+		}
+	}
+	return recipients, nil
 }
 
-// Get unique recipients by owner account
+// Get unique recipients by owner account.  If recipients being merged had their own (csv) amounts, they're combined
+// so the owner still receives the total.  Per-NFD weights are combined as well - but not holding-based weights
+// as those are already per owner.
 func getUniqueRecipients(recipients []*Recipient) []*Recipient {
 	uniqueOwners := map[string]*Recipient{}
 	for _, recipient := range recipients {
+		if existing, found := uniqueOwners[recipient.OwnerAccount]; found {
+			if existing.AmountOverride != nil {
+				if recipient.AmountOverride == nil {
+					recipient.AmountOverride = &AmountOverride{}
+				}
+				recipient.AmountOverride.add(existing.AmountOverride)
+			}
+			if sendConfig.Distribution.Strategy != DistributeByHolding {
+				recipient.Weight += existing.Weight
+			}
+		}
 		uniqueOwners[recipient.OwnerAccount] = recipient
 	}
 
@@ -74,20 +156,35 @@ func sortByDepositAccount(recipients []*Recipient) {
 // specified in the DestinationChoice of the config, it fetches the segments of
 // the specified rootNfdName and returns them. It also checks if SendToVault is set
 // and ensures that choice is passed through to filter out ineligible vaults (NFDs not upgraded or vault locked)
-func getNfdsToChooseFrom(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
+// For csv files, any per-row amounts are returned as well, keyed by the nfd name of the row.
+func getNfdsToChooseFrom(config *BatchSendConfig) ([]*nfdapi.NfdRecord, map[string]*csvRowValues, error) {
 	var (
 		nfdRecords []*nfdapi.NfdRecord
+		csvValues  = map[string]*csvRowValues{}
 		err        error
 	)
+	if config.Destination.Search != nil && (config.Destination.CsvFile != "" || config.Destination.HolderSnapshot != nil) {
+		return nil, nil, errors.New("search filters only apply when searching NFDs - not with a csvFile or holderSnapshot")
+	}
 	if config.Destination.CsvFile != "" {
 		// read data from the csv file determining which column contains the nfd name (with column name 'name', or 'nfd')
 		var (
-			fanSize    = 40
+			fanSize    = nfdThrottle.maxAtOnce // every fetch is an NFD API call - no point having more going than it allows
 			csvRecords []map[string]string
 			fanOut     = syncutil.NewFanOut(fanSize)
-			limiter    = rate.NewLimiter(rate.Every(time.Minute/3900), fanSize)
 		)
 		csvRecords, err = processCsvFile(config.Destination.CsvFile)
+		if err == nil && !nfdEnabled() {
+			for _, csvRecord := range csvRecords {
+				if csvRecord["account"] == "" && csvRecord["nfd"] != "" {
+					err = fmt.Errorf("csv file has nfd %s but there's no NFD API configured - only accounts can be used", csvRecord["nfd"])
+					break
+				}
+			}
+		}
+		if err == nil {
+			csvValues, err = getCsvRowValues(config, csvRecords)
+		}
 		if err == nil {
 			misc.Infof(logger, "..read %d records from csv file", len(csvRecords))
 			nfdFetchChan := make(chan *nfdapi.NfdRecord, fanSize)
@@ -96,25 +193,7 @@ func getNfdsToChooseFrom(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 					if csvRecord["account"] != "" {
 						account := csvRecord["account"]
 						// Create a synthetic NFD record with the account address as the NFD name
-						nfdFetchChan <- &nfdapi.NfdRecord{
-							CaAlgo:         []string{account},
-							Name:           strings.ToLower(csvRecord["account"][:32]) + ".fake",
-							Category:       "premiun",
-							DepositAccount: account,
-							Expired:        false,
-							Owner:          account,
-							ParentAppID:    0,
-							Properties: &nfdapi.NfdProperties{
-								Internal:    map[string]string{},
-								UserDefined: map[string]string{},
-								Verified:    map[string]string{},
-							},
-							State:         "owned",
-							TimeChanged:   time.Now(),
-							TimeCreated:   time.Now(),
-							TimeExpires:   time.Now(),
-							TimePurchased: time.Now(),
-						}
+						nfdFetchChan <- accountNfdRecord(account)
 						continue
 					} else if csvRecord["nfd"] == "" {
 						continue
@@ -130,9 +209,6 @@ func getNfdsToChooseFrom(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 							err        error
 						)
 						err = retryNfdApiCalls(func() error {
-							if err := limiter.Wait(ctx); err != nil {
-								return repeat.HintStop(err)
-							}
 							fetchedNfd, _, err = api.NfdApi.NfdGetNFD(ctx, nfdName, &nfdapi.NfdApiNfdGetNFDOpts{
 								View: optional.NewString(view),
 							})
@@ -157,7 +233,15 @@ func getNfdsToChooseFrom(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 					misc.Infof(logger, "..fetched %d NFDs", len(nfdRecords))
 				}
 			}
+			if nfdEnabled() {
+				err = resolveCsvAccounts(config, nfdRecords, csvValues)
+			}
 		}
+	} else if config.Destination.HolderSnapshot != nil {
+		if config.Destination.SegmentsOfRoot != "" {
+			return nil, nil, errors.New("holderSnapshot and segmentsOfRoot can't both be specified")
+		}
+		nfdRecords, err = getSnapshotNfds(config.Destination.HolderSnapshot)
 	} else {
 		if config.Destination.SegmentsOfRoot != "" {
 			if config.Destination.OnlyRoots {
@@ -169,10 +253,162 @@ func getNfdsToChooseFrom(config *BatchSendConfig) ([]*nfdapi.NfdRecord, error) {
 		}
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error in getNfdsToChooseFrom: %w", err)
+		return nil, nil, fmt.Errorf("error in getNfdsToChooseFrom: %w", err)
 	}
 	misc.Infof(logger, "..total of %d NFDs found before next filter step", len(nfdRecords))
-	return filterNfds(config, nfdRecords)
+	nfdRecords, err = filterNfds(config, nfdRecords)
+	if err == nil && (config.Destination.Include != nil || config.Destination.Exclude != nil) {
+		nfdRecords, err = applyRecipientLists(config, nfdRecords)
+	}
+	if err == nil && config.Destination.HoldsAssets != nil {
+		nfdRecords, err = filterByHoldings(config.Destination.HoldsAssets, nfdRecords)
+	}
+	return nfdRecords, csvValues, err
+}
+
+// resolveCsvAccounts resolves the account rows of a csv file to their primary NFD where they have one - reporting
+// each row that was, and each that fell back to being a bare account.  Row values are re-keyed to the NFD name.
+func resolveCsvAccounts(config *BatchSendConfig, records []*nfdapi.NfdRecord, csvValues map[string]*csvRowValues) error {
+	var (
+		accountRecords []*nfdapi.NfdRecord
+		fakeNames      []string            // fake names of the account records, as enriching renames them
+		named          = map[string]bool{} // nfd rows - accounts of those NFDs are kept as bare accounts
+	)
+	for _, record := range records {
+		if isFakeNfd(record) {
+			accountRecords = append(accountRecords, record)
+			fakeNames = append(fakeNames, record.Name)
+		} else {
+			named[record.Name] = true
+		}
+	}
+	if len(accountRecords) == 0 {
+		return nil
+	}
+	view := "brief"
+	if len(config.Destination.VerifiedRequirements) > 0 {
+		view = "full"
+	}
+	misc.Infof(logger, "..looking up NFDs of %d csv account rows", len(accountRecords))
+	resolved, err := enrichWithNfds(accountRecords, view, named)
+	if err != nil {
+		return err
+	}
+	for i, record := range accountRecords {
+		nfdName, found := resolved[record.Owner]
+		if !found {
+			misc.Infof(logger, "  csv account %s has no NFD - kept as a bare account (no vault or NFD filters)", record.Owner)
+			continue
+		}
+		misc.Infof(logger, "  csv account %s resolved to %s", record.Owner, nfdName)
+		if rowValues, found := csvValues[fakeNames[i]]; found {
+			delete(csvValues, fakeNames[i])
+			csvValues[nfdName] = rowValues
+		}
+	}
+	misc.Infof(logger, "..%d csv account rows resolved to an NFD, %d kept as bare accounts", len(resolved), len(accountRecords)-len(resolved))
+	return nil
+}
+
+// fakeNfdSuffix marks the names of synthetic NFD records - real NFD names always end in .algo
+const fakeNfdSuffix = ".fake"
+
+// fakeNfdName is the name given to the synthetic NFD record created for 'account' rows of a csv file
+func fakeNfdName(account string) string {
+	return strings.ToLower(account[:min(len(account), 32)]) + fakeNfdSuffix
+}
+
+// isFakeNfd returns true if the record is a synthetic one for a bare account (see accountNfdRecord)
+func isFakeNfd(record *nfdapi.NfdRecord) bool {
+	return strings.HasSuffix(record.Name, fakeNfdSuffix)
+}
+
+// getCsvRowValues returns the per-row amounts (if any) from the 'amount' and 'amount_<asa>' columns, and the
+// per-row weight if distributing by a csv column - keyed by the nfd name the row refers to.
+func getCsvRowValues(config *BatchSendConfig, csvRecords []map[string]string) (map[string]*csvRowValues, error) {
+	var (
+		csvValues    = map[string]*csvRowValues{}
+		weightColumn string
+		numAmounts   int
+	)
+	if config.Distribution.Strategy == DistributeByCsvColumn {
+		weightColumn = strings.ToLower(config.Distribution.CsvColumn)
+		if weightColumn == "" {
+			return nil, errors.New("distribution by csv column requires a csvColumn name")
+		}
+	}
+	for _, csvRecord := range csvRecords {
+		var (
+			override AmountOverride
+			weight   *float64
+		)
+		for colName, value := range csvRecord {
+			if value == "" {
+				continue
+			}
+			if weightColumn != "" && colName == weightColumn {
+				rowWeight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || rowWeight < 0 || math.IsNaN(rowWeight) || math.IsInf(rowWeight, 0) {
+					return nil, fmt.Errorf("invalid %s weight value:%s in csv file", colName, value)
+				}
+				weight = &rowWeight
+				continue
+			}
+			if !strings.HasPrefix(colName, "amount") {
+				continue
+			}
+			amount, err := ParseAmount(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value:%s in csv file: %w", colName, value, err)
+			}
+			if colName == "amount" {
+				override.Amount = &amount
+				continue
+			}
+			assetID, err := strconv.ParseUint(strings.TrimPrefix(colName, "amount_"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid amount column:%s in csv file - must be amount or amount_<asa id>", colName)
+			}
+			if override.AssetAmounts == nil {
+				override.AssetAmounts = map[uint64]Amount{}
+			}
+			override.AssetAmounts[assetID] = amount
+		}
+		hasAmount := override.Amount != nil || override.AssetAmounts != nil
+		if !hasAmount && weight == nil {
+			continue
+		}
+		var key string
+		if csvRecord["account"] != "" {
+			key = fakeNfdName(csvRecord["account"])
+		} else if csvRecord["nfd"] != "" {
+			key = strings.ToLower(strings.TrimSpace(csvRecord["nfd"]))
+		} else {
+			continue
+		}
+		rowValues, found := csvValues[key]
+		if !found {
+			rowValues = &csvRowValues{}
+			csvValues[key] = rowValues
+		}
+		if hasAmount {
+			numAmounts++
+			if rowValues.amounts == nil {
+				rowValues.amounts = &AmountOverride{}
+			}
+			rowValues.amounts.add(&override)
+		}
+		if weight != nil {
+			if rowValues.weight != nil {
+				*weight += *rowValues.weight
+			}
+			rowValues.weight = weight
+		}
+	}
+	if numAmounts > 0 {
+		misc.Infof(logger, "..%d csv rows specify their own amount", numAmounts)
+	}
+	return csvValues, nil
 }
 
 func filterNfds(config *BatchSendConfig, records []*nfdapi.NfdRecord) ([]*nfdapi.NfdRecord, error) {
@@ -289,15 +525,20 @@ func createRecipient(config *BatchSendConfig, destNfd *nfdapi.NfdRecord, sending
 		if sendingFromVault != nil && sendingFromVault.NfdAccount == deposit {
 			return nil // don't send to self!
 		}
-	} else {
-		// since not sending to a vault
 	}
-	return &Recipient{
+	recipient := &Recipient{
 		NfdName:        destNfd.Name,
 		OwnerAccount:   destNfd.Owner,
 		DepositAccount: deposit,
 		SendToVault:    config.Destination.SendToVaults,
+		AppID:          destNfd.AppID,
+	}
+	if !config.Destination.SendToVaults && destNfd.NfdAccount != "" && canReceiveToVault(destNfd) &&
+		(sendingFromVault == nil || sendingFromVault.NfdAccount != destNfd.NfdAccount) {
+		// kept in case they aren't opted-in and we fall back to sending to their vault
+		recipient.VaultAccount = destNfd.NfdAccount
 	}
+	return recipient
 }
 
 func processCsvFile(csvFile string) ([]map[string]string, error) {
@@ -321,12 +562,14 @@ func processCsvFile(csvFile string) ([]map[string]string, error) {
 	nameIndex := -1
 	accountIndex := -1
 	for i, colName := range header {
-		if strings.EqualFold(colName, "name") || strings.EqualFold(colName, "nfd") {
-			nameIndex = i
-			break
-		} else if strings.EqualFold(colName, "account") {
-			accountIndex = i
-			break
+		// column names are treated case-insensitively
+		header[i] = strings.ToLower(strings.TrimSpace(colName))
+		if nameIndex == -1 && accountIndex == -1 {
+			if header[i] == "name" || header[i] == "nfd" {
+				nameIndex = i
+			} else if header[i] == "account" {
+				accountIndex = i
+			}
 		}
 	}
 
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
+)
+
+// isExpired returns true if the send failed because its validity window passed - whether rejected as already
+// expired when sent, or never confirmed before it expired.
+func isExpired(err error) bool {
+	return errorClass(err) == ErrClassExpired
+}
+
+// txnsValidity returns the first and last valid rounds of the signed txns of a send - taken from the txns themselves
+// as vault sends are built by the NFD API with its own params, not those we asked for.  The last valid round is the
+// latest of any of the txns, so once the chain is past it none of them can be confirmed.
+func txnsValidity(signedBytes []byte) (uint64, uint64, error) {
+	stxns, err := algo.DecodeSignedTxns(signedBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(stxns) == 0 {
+		return 0, 0, errors.New("no signed txns to send")
+	}
+	firstValid, lastValid := uint64(stxns[0].Txn.FirstValid), uint64(stxns[0].Txn.LastValid)
+	for _, stxn := range stxns[1:] {
+		firstValid = min(firstValid, uint64(stxn.Txn.FirstValid))
+		lastValid = max(lastValid, uint64(stxn.Txn.LastValid))
+	}
+	return firstValid, lastValid, nil
+}
+
+// expiredSendLanded makes sure a send whose validity window has passed really didn't land - returning the round
+// it was confirmed in if it did (0 if not).  Once the chain is past its last valid round it can never be
+// confirmed, so it's then safe to send again.
+func expiredSendLanded(txid string, lastValid uint64) (uint64, error) {
+	var (
+		pendingInfo models.PendingTransactionInfoResponse
+		err         error
+	)
+	err = retryAlgoCalls(func() error {
+		status, err := algoClient.Status().Do(ctx)
+		if err == nil && status.LastRound <= lastValid {
+			_, err = algoClient.StatusAfterBlock(lastValid).Do(ctx)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = retryAlgoCalls(func() error {
+		pendingInfo, _, err = algoClient.PendingTransactionInformation(txid).Do(ctx)
+		return err
+	})
+	if err == nil {
+		// rejected, or still in the pool past its last valid round - neither can be confirmed now
+		return pendingInfo.ConfirmedRound, nil
+	}
+	if !isAlgoNotFound(err) {
+		return 0, err
+	}
+	if indexerClient == nil {
+		// the node no longer knows of it, and it wasn't seen confirmed while we waited for it
+		return 0, nil
+	}
+	var txnResp models.TransactionResponse
+	err = retryAlgoCalls(func() error {
+		txnResp, err = indexerClient.LookupTransaction(txid).Do(ctx)
+		return err
+	})
+	if isAlgoNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to look up txn in indexer: %w", err)
+	}
+	return txnResp.Transaction.ConfirmedRound, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
+)
+
+// Results file formats
+const (
+	ResultsJSONL = "jsonl"
+	ResultsCSV   = "csv"
+)
+
+// Error classes of failed sends - so failures can be handled (and retried) by type rather than by parsing messages
+const (
+	ErrClassNotOptedIn   = "notOptedIn"
+	ErrClassFrozen       = "frozen"
+	ErrClassInsufficient = "insufficientFunds"
+	ErrClassLeaseInUse   = "leaseInUse"
+	ErrClassVaultLocked  = "vaultLocked"
+	ErrClassExpired      = "expired"
+	ErrClassNetwork      = "network"
+	ErrClassNfdApi       = "nfdApi"
+	ErrClassOther        = "other"
+)
+
+// nfdApiErrorPrefix starts the errors of failed NFD API calls building vault sends (see getAssetSendTxns)
+const nfdApiErrorPrefix = "error in NfdSendToVault call"
+
+var (
+	// rejections by algod (ie: HTTP 400: {"message":"TransactionPool.Remember: transaction XXX: asset 123 missing
+	// from YYY"}) - matched on their whole shape so amounts, asset ids or notes in the error can't match by chance
+	notOptedInPattern   = regexp.MustCompile(`asset \d+ missing from [A-Z2-7]{58}`)
+	frozenPattern       = regexp.MustCompile(`asset \d+ frozen in [A-Z2-7]{58}`)
+	insufficientPattern = regexp.MustCompile(`overspend \(account [A-Z2-7]{58}|balance \d+ below min \d+|underflow on subtracting \d+ from sender amount \d+`)
+	leaseInUsePattern   = regexp.MustCompile(`using an overlapping lease`)
+	// algod rejecting it as past its validity window, or the confirmation wait running out
+	expiredPattern = regexp.MustCompile(`txn dead: round \d+ outside of \d+--\d+|Wait for transaction id [A-Z2-7]+ timed out`)
+	// overloaded or unreachable - an HTTP status (from algod as 'HTTP 503:', from the NFD API as '503 Service
+	// Unavailable') or a transport failure
+	networkPattern = regexp.MustCompile(`HTTP (429|502|503|504):|\b(429 Too Many Requests|502 Bad Gateway|503 Service Unavailable|504 Gateway Timeout)\b|` +
+		`connection refused|connection reset|broken pipe|i/o timeout|no such host|TLS handshake timeout|context deadline exceeded|unexpected EOF`)
+)
+
+// errorClass categorizes the error of a failed send by what algod (or the NFD API) reported.
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	errStr := err.Error()
+	if strings.Contains(errStr, nfdApiErrorPrefix) {
+		// the NFD API failed to build the vault send - nothing was sent
+		switch {
+		case networkPattern.MatchString(errStr):
+			return ErrClassNetwork
+		case strings.Contains(strings.ToLower(errStr), "locked"):
+			return ErrClassVaultLocked
+		default:
+			return ErrClassNfdApi
+		}
+	}
+	switch {
+	case notOptedInPattern.MatchString(errStr):
+		return ErrClassNotOptedIn
+	case frozenPattern.MatchString(errStr):
+		return ErrClassFrozen
+	case insufficientPattern.MatchString(errStr):
+		return ErrClassInsufficient
+	case leaseInUsePattern.MatchString(errStr):
+		return ErrClassLeaseInUse
+	case expiredPattern.MatchString(errStr):
+		return ErrClassExpired
+	case networkPattern.MatchString(errStr):
+		return ErrClassNetwork
+	default:
+		return ErrClassOther
+	}
+}
+
+// isPermanentErrorClass returns true for failures that will fail the same way if retried - the recipient has to do
+// something first (opt-in, unlock their vault) or the asset has to be unfrozen.
+func isPermanentErrorClass(errClass string) bool {
+	switch errClass {
+	case ErrClassNotOptedIn, ErrClassFrozen, ErrClassVaultLocked:
+		return true
+	}
+	return false
+}
+
+// ResultRecord is the structured result of a single send, as written to the results file
+type ResultRecord struct {
+	RunID          string    `json:"run"`
+	Time           time.Time `json:"time"`
+	NfdName        string    `json:"nfd"`
+	OwnerAccount   string    `json:"owner"`
+	DepositAccount string    `json:"depositAccount"`
+	SendToVault    bool      `json:"sendToVault"`
+	AssetID        uint64    `json:"asset"`
+	Amount         uint64    `json:"amount"`
+	DisplayAmount  string    `json:"displayAmount"`
+	TxID           string    `json:"txid,omitempty"`
+	Round          uint64    `json:"round,omitempty"`
+	Fee            uint64    `json:"fee"`
+	ErrorClass     string    `json:"errorClass,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+var resultsCsvHeader = []string{"run", "time", "nfd", "owner", "depositAccount", "sendToVault", "asset", "amount",
+	"displayAmount", "txid", "round", "fee", "errorClass", "error"}
+
+func (rr *ResultRecord) csvRow() []string {
+	return []string{
+		rr.RunID,
+		rr.Time.Format(time.RFC3339),
+		rr.NfdName,
+		rr.OwnerAccount,
+		rr.DepositAccount,
+		strconv.FormatBool(rr.SendToVault),
+		strconv.FormatUint(rr.AssetID, 10),
+		strconv.FormatUint(rr.Amount, 10),
+		rr.DisplayAmount,
+		rr.TxID,
+		strconv.FormatUint(rr.Round, 10),
+		strconv.FormatUint(rr.Fee, 10),
+		rr.ErrorClass,
+		rr.Error,
+	}
+}
+
+func newResultRecord(result *RecipientTransaction) *ResultRecord {
+	record := &ResultRecord{
+		RunID:          runID,
+		Time:           time.Now().UTC(),
+		NfdName:        result.recip.NfdName,
+		OwnerAccount:   result.recip.OwnerAccount,
+		DepositAccount: result.recip.DepositAccount,
+		SendToVault:    result.recip.SendToVault,
+		AssetID:        result.sendAsset.AssetID,
+		Amount:         result.baseUnitsToSend,
+		DisplayAmount:  result.sendAsset.formattedAmount(result.baseUnitsToSend),
+		TxID:           result.txid(),
+		Round:          result.Success.round,
+		Fee:            result.fee,
+		ErrorClass:     errorClass(result.Error),
+	}
+	if result.Error != nil {
+		record.Error = result.Error.Error()
+	}
+	return record
+}
+
+// ResultsFile writes a structured record of the result of every send - in json lines or csv format.  Resumed runs
+// append to the results file of the original run.
+type ResultsFile struct {
+	mu        sync.Mutex
+	format    string
+	filename  string
+	file      *os.File
+	csvWriter *csv.Writer
+}
+
+// OpenResultsFile opens (or creates) results.<format> in the run directory for appending
+func OpenResultsFile(runDir string, format string) (*ResultsFile, error) {
+	if format != ResultsJSONL && format != ResultsCSV {
+		return nil, fmt.Errorf("unknown results format:%s, must be jsonl or csv", format)
+	}
+	filename := filepath.Join(runDir, "results."+format)
+	_, statErr := os.Stat(filename)
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening results file: %w", err)
+	}
+	results := &ResultsFile{format: format, filename: filename, file: file}
+	if format == ResultsCSV {
+		results.csvWriter = csv.NewWriter(file)
+		if errors.Is(statErr, fs.ErrNotExist) {
+			results.csvWriter.Write(resultsCsvHeader)
+		}
+	}
+	return results, nil
+}
+
+// record writes the result of a send - failures to write are fatal, like the success/failure files.
+func (rf *ResultsFile) record(result *RecipientTransaction) {
+	if rf == nil {
+		return
+	}
+	record := newResultRecord(result)
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	var err error
+	if rf.format == ResultsCSV {
+		rf.csvWriter.Write(record.csvRow())
+		rf.csvWriter.Flush()
+		err = rf.csvWriter.Error()
+	} else {
+		var line []byte
+		if line, err = json.Marshal(record); err == nil {
+			_, err = rf.file.Write(append(line, '\n'))
+		}
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed writing to results file %s: %s", rf.filename, err))
+		os.Exit(1)
+	}
+}
+
+func (rf *ResultsFile) Close() {
+	if rf != nil {
+		rf.file.Close()
+	}
+}
+
+// txnsFee returns the total fee of the (outer) signed txns of a send
+func txnsFee(signedBytes []byte) uint64 {
+	stxns, err := algo.DecodeSignedTxns(signedBytes)
+	if err != nil {
+		return 0
+	}
+	var fee uint64
+	for _, stxn := range stxns {
+		fee += uint64(stxn.Txn.Fee)
+	}
+	return fee
+}
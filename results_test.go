@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	const (
+		addr = "BH55E5RMBD4GYWXGX5W5PJ5JAHPGM5OXKDQH5DC4O2MGI7NW4H6VOE4CP4"
+		txid = "TXSKYJQGHVRV5K4A3UZCXGM2Y5ZJ4SMXLYWTZ7B7YWZSZ2G6ZFFA"
+	)
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "none", err: nil, want: ""},
+		{name: "receiver not opted-in",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction ` + txid + `: receiver error: must optin, asset 123456 missing from ` + addr + `"}`),
+			want: ErrClassNotOptedIn},
+		{name: "sender frozen",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction ` + txid + `: asset 123456 frozen in ` + addr + `"}`),
+			want: ErrClassFrozen},
+		{name: "overspend",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction ` + txid + `: overspend (account ` + addr + `, data {_struct:{} Status:Offline MicroAlgos:{Raw:100000}}, tried to spend {1000})"}`),
+			want: ErrClassInsufficient},
+		{name: "below min balance",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction ` + txid + `: account ` + addr + ` balance 99000 below min 100000 (0 assets)"}`),
+			want: ErrClassInsufficient},
+		{name: "asset underflow",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction ` + txid + `: underflow on subtracting 500 from sender amount 100"}`),
+			want: ErrClassInsufficient},
+		{name: "lease in use",
+			err:  errors.New(`sendTxns rejected as an earlier copy of this send (same lease) is still valid and may have already been sent: HTTP 400: {"message":"TransactionPool.Remember: transaction ` + txid + ` using an overlapping lease (sender, lease):(` + addr + `, [1 2 3])"}`),
+			want: ErrClassLeaseInUse},
+		{name: "txn dead",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: txn dead: round 46000123 outside of 45999000--46000000"}`),
+			want: ErrClassExpired},
+		{name: "confirmation wait timed out",
+			err:  errors.New(`waiting for txn: waitForTxn failure in confirmation wait: Wait for transaction id ` + txid + ` timed out`),
+			want: ErrClassExpired},
+		{name: "algod overloaded",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 503: {"message":"Service Unavailable"}`),
+			want: ErrClassNetwork},
+		{name: "algod rate limited",
+			err:  errors.New(`waiting for group txn: waitForTxn failure in confirmation wait: HTTP 429: Too Many Requests`),
+			want: ErrClassNetwork},
+		{name: "connection refused",
+			err:  errors.New(`sendTxns failed to send txns: Post "http://localhost:4001/v2/transactions": dial tcp 127.0.0.1:4001: connect: connection refused`),
+			want: ErrClassNetwork},
+		{name: "connection reset",
+			err:  errors.New(`waiting for txn: waitForTxn failure in confirmation wait: Get "https://mainnet-api.4160.nodely.dev/v2/status/wait-for-block-after/46000000": read tcp 10.0.0.2:51234->1.2.3.4:443: read: connection reset by peer`),
+			want: ErrClassNetwork},
+		{name: "nfd api gateway",
+			err:  errors.New(`failure getting txns: ` + nfdApiErrorPrefix + `: 502 Bad Gateway`),
+			want: ErrClassNetwork},
+		{name: "nfd api vault locked",
+			err:  errors.New(`failure getting txns: ` + nfdApiErrorPrefix + `: message:vault is locked, err:400 Bad Request`),
+			want: ErrClassVaultLocked},
+		{name: "nfd api error mentioning numbers",
+			err:  errors.New(`failure getting txns: ` + nfdApiErrorPrefix + `: message:asset 4290000 is not valid for this vault, err:400 Bad Request`),
+			want: ErrClassNfdApi},
+		{name: "nfd api not found",
+			err:  errors.New(`failure getting txns: ` + nfdApiErrorPrefix + `: message:nfd not found, err:404 Not Found`),
+			want: ErrClassNfdApi},
+		{name: "amounts aren't status codes",
+			err:  errors.New(`sendTxns failed to send txns: HTTP 400: {"message":"logic eval error: amount 5030000 exceeds 4290000"}`),
+			want: ErrClassOther},
+		{name: "other",
+			err:  errors.New(`failure getting txns: MakeAssetTransferTxn fail: invalid address`),
+			want: ErrClassOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorClass(tt.err); got != tt.want {
+				t.Errorf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
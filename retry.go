@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+// retryPlan rebuilds the plan from just the failed sends recorded in a prior run's journal or results file - with
+// the same recipients, amounts and vault choice.  Failures that would only fail again (see isPermanentErrorClass)
+// are left out, as are sends that may have landed despite being recorded as failed - only those surely not on chain
+// are sent again.
+// The run id of the prior run is returned as well, so retried sends carry the same leases.
+func retryPlan(filename string, assets []*SendAsset) (string, []*PlannedSend, error) {
+	entries, err := loadRecordedSends(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	var (
+		priorRunID  string
+		plan        []*PlannedSend
+		assetsByID  = map[uint64]*SendAsset{}
+		numFailed   int
+		permanent   = map[string]int{}
+		numLanded   int
+		numUnknowns int
+	)
+	for _, asset := range assets {
+		assetsByID[asset.AssetID] = asset
+	}
+	for _, entry := range entries {
+		if priorRunID == "" {
+			priorRunID = entry.RunID
+		}
+		if entry.State != JournalFailed && (entry.State != "" || entry.Error == "") {
+			continue
+		}
+		numFailed++
+		errClass := errorClass(errors.New(entry.Error))
+		if isPermanentErrorClass(errClass) {
+			misc.Infof(logger, "..not retrying %s to %s - %s: %s", sendKind(entry), entry.NfdName, errClass, entry.Error)
+			permanent[errClass]++
+			continue
+		}
+		if errClass == ErrClassLeaseInUse {
+			// an earlier copy of this send was still valid - it may have landed
+			misc.Infof(logger, "..not retrying %s to %s - an earlier copy may have landed, check manually", sendKind(entry), entry.NfdName)
+			numUnknowns++
+			continue
+		}
+		if entry.TxID == "" && (errClass == ErrClassNetwork || errClass == ErrClassExpired) && !strings.HasPrefix(entry.Error, "failure getting txns") {
+			// failed once sent, but with no txid to check whether it landed
+			misc.Infof(logger, "..not retrying %s to %s - %s failure with no txid recorded, it may have landed, check manually", sendKind(entry), entry.NfdName, errClass)
+			numUnknowns++
+			continue
+		}
+		if entry.TxID != "" {
+			// failed after it was submitted (ie: confirmation wait failed) - only retried if it surely didn't land
+			outcome, detail := verifySend(entry)
+			if outcome == VerifyPending && entry.LastValid != 0 && pastLastValid(entry.LastValid) {
+				// stuck in the pool past its validity window - it can never be confirmed
+				outcome = VerifyMissing
+			}
+			switch outcome {
+			case VerifyOK:
+				misc.Infof(logger, "..not retrying %s to %s - txid:%s landed after all", sendKind(entry), entry.NfdName, entry.TxID)
+				numLanded++
+				continue
+			case VerifyMissing:
+				// rejected by the node, or not on chain according to the indexer
+			default:
+				misc.Infof(logger, "..not retrying %s to %s - txid:%s is %s (%s), check manually", sendKind(entry), entry.NfdName, entry.TxID, outcome, detail)
+				numUnknowns++
+				continue
+			}
+		}
+		asset, found := assetsByID[entry.AssetID]
+		if !found {
+			return "", nil, fmt.Errorf("failed send of asset %d isn't available to send", entry.AssetID)
+		}
+		recipient := &Recipient{
+			NfdName:        entry.NfdName,
+			OwnerAccount:   entry.OwnerAccount,
+			DepositAccount: entry.DepositAccount,
+			SendToVault:    entry.SendToVault,
+		}
+		if sendConfig.Send.Nfts != nil {
+			recipient.NftAssetID = entry.AssetID
+		}
+		plan = append(plan, &PlannedSend{asset: asset, recipient: recipient, amount: entry.Amount})
+	}
+	if priorRunID == "" {
+		return "", nil, fmt.Errorf("%s has no sends (or run id) in it", filename)
+	}
+	misc.Infof(logger, "%s: %d sends, %d failed, retrying %d", filename, len(entries), numFailed, len(plan))
+	for errClass, count := range permanent {
+		misc.Infof(logger, "..%d not retried as %s", count, errClass)
+	}
+	if numLanded > 0 || numUnknowns > 0 {
+		misc.Infof(logger, "..%d not retried as they landed, %d as their outcome is unknown", numLanded, numUnknowns)
+	}
+	return priorRunID, plan, nil
+}
+
+// pastLastValid returns true if the chain is past the last valid round of a txn - so it can no longer be confirmed.
+// Errors getting the status are taken as not past it.
+func pastLastValid(lastValid uint64) bool {
+	var lastRound uint64
+	err := retryAlgoCalls(func() error {
+		status, err := algoClient.Status().Do(ctx)
+		lastRound = status.LastRound
+		return err
+	})
+	return err == nil && lastRound > lastValid
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+)
+
+const (
+	testAddr = "BH55E5RMBD4GYWXGX5W5PJ5JAHPGM5OXKDQH5DC4O2MGI7NW4H6VOE4CP4"
+	// errors of failed sends, as recorded
+	errNotOptedIn = `sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction TXB: receiver error: must optin, asset 1000 missing from ` + testAddr + `"}`
+	errFrozen     = `sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction TXC: asset 1000 frozen in ` + testAddr + `"}`
+	errLocked     = `failure getting txns: ` + nfdApiErrorPrefix + `: message:vault is locked, err:400 Bad Request`
+	errLeaseInUse = `sendTxns rejected as an earlier copy of this send (same lease) is still valid and may have already been sent: HTTP 400: {"message":"TransactionPool.Remember: transaction TXE using an overlapping lease (sender, lease):(` + testAddr + `, [1 2 3])"}`
+	errNetwork    = `waiting for txn: waitForTxn failure in confirmation wait: HTTP 503: {"message":"Service Unavailable"}`
+	errNfdGateway = `failure getting txns: ` + nfdApiErrorPrefix + `: 502 Bad Gateway`
+	errOverspend  = `sendTxns failed to send txns: HTTP 400: {"message":"TransactionPool.Remember: transaction TXH: overspend (account ` + testAddr + `, data {_struct:{} Status:Offline MicroAlgos:{Raw:100000}}, tried to spend {1000})"}`
+	errTimedOut   = `waiting for txn: waitForTxn failure in confirmation wait: Wait for transaction id TXSENT timed out`
+)
+
+// retryTestChain knows of the sends that were submitted - one landed, one is stuck in the pool past its last valid
+// round, one is still pending within it, and one never made it
+func retryTestChain() *fakeChain {
+	return &fakeChain{
+		lastRound: 2000,
+		pending: map[string]models.PendingTransactionInfoResponse{
+			"TXEXPIRED": {},
+			"TXPENDING": {},
+		},
+		indexed: map[string]models.Transaction{
+			"TXLANDED": {
+				Type:           "axfer",
+				ConfirmedRound: 1400,
+				AssetTransferTransaction: models.TransactionAssetTransfer{
+					Receiver: "III",
+					AssetId:  1000,
+					Amount:   9,
+				},
+			},
+		},
+	}
+}
+
+func TestRetryPlan(t *testing.T) {
+	setupTestGlobals(t, retryTestChain(), true)
+	filename := writeJournalFixture(t,
+		`{"state":"confirmed","nfd":"a.algo","depositAccount":"AAA","asset":1000,"amount":1,"txid":"TXA","round":1200}`,
+		// permanent failures
+		`{"state":"failed","nfd":"b.algo","depositAccount":"BBB","asset":1000,"amount":2,"error":`+jsonStr(errNotOptedIn)+`}`,
+		`{"state":"failed","nfd":"c.algo","depositAccount":"CCC","asset":1000,"amount":3,"error":`+jsonStr(errFrozen)+`}`,
+		`{"state":"failed","nfd":"d.algo","depositAccount":"DDD","sendToVault":true,"asset":1000,"amount":4,"error":`+jsonStr(errLocked)+`}`,
+		// an earlier copy may have landed
+		`{"state":"failed","nfd":"e.algo","depositAccount":"EEE","asset":1000,"amount":5,"error":`+jsonStr(errLeaseInUse)+`}`,
+		// failed once sent, with no txid to check
+		`{"state":"failed","nfd":"f.algo","depositAccount":"FFF","asset":1000,"amount":6,"error":`+jsonStr(errNetwork)+`}`,
+		// failed building it, so never sent
+		`{"state":"failed","nfd":"g.algo","depositAccount":"GGG","sendToVault":true,"asset":1000,"amount":7,"error":`+jsonStr(errNfdGateway)+`}`,
+		`{"state":"failed","nfd":"h.algo","depositAccount":"HHH","asset":2000,"amount":8,"error":`+jsonStr(errOverspend)+`}`,
+		// submitted, then the confirmation wait failed - the txid is kept from the submitted entry
+		`{"state":"submitted","nfd":"i.algo","depositAccount":"III","asset":1000,"amount":9,"txid":"TXLANDED","lastValid":1450}`,
+		`{"state":"failed","nfd":"i.algo","depositAccount":"III","asset":1000,"amount":9,"error":`+jsonStr(errTimedOut)+`}`,
+		`{"state":"submitted","nfd":"j.algo","depositAccount":"JJJ","asset":1000,"amount":10,"txid":"TXEXPIRED","lastValid":1500}`,
+		`{"state":"failed","nfd":"j.algo","depositAccount":"JJJ","asset":1000,"amount":10,"error":`+jsonStr(errTimedOut)+`}`,
+		`{"state":"submitted","nfd":"k.algo","depositAccount":"KKK","asset":1000,"amount":11,"txid":"TXPENDING","lastValid":2500}`,
+		`{"state":"failed","nfd":"k.algo","depositAccount":"KKK","asset":1000,"amount":11,"error":`+jsonStr(errTimedOut)+`}`,
+		`{"state":"submitted","nfd":"l.algo","depositAccount":"LLL","asset":1000,"amount":12,"txid":"TXGONE","lastValid":1500}`,
+		`{"state":"failed","nfd":"l.algo","depositAccount":"LLL","asset":1000,"amount":12,"error":`+jsonStr(errTimedOut)+`}`,
+		// never attempted - left for -resume, not -retry
+		`{"state":"planned","nfd":"m.algo","depositAccount":"MMM","asset":1000,"amount":13}`,
+	)
+	runID, plan, err := retryPlan(filename, testAssets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runID != testRunID {
+		t.Errorf("run id = %q, want %q", runID, testRunID)
+	}
+	// not sent (building it failed, or rejected as overspent), stuck past its last valid round, and not on chain
+	want := []string{"g.algo/1000/7", "h.algo/2000/8", "j.algo/1000/10", "l.algo/1000/12"}
+	if got := planSummary(plan); !slices.Equal(got, want) {
+		t.Errorf("retryPlan = %v, want %v", got, want)
+	}
+	if len(plan) > 0 && !plan[0].recipient.SendToVault {
+		t.Errorf("retried vault send of %s isn't to its vault", plan[0].recipient.NfdName)
+	}
+}
+
+func TestRetryPlanResultsFormats(t *testing.T) {
+	setupTestGlobals(t, retryTestChain(), true)
+	records := []*ResultRecord{
+		{NfdName: "a.algo", DepositAccount: "AAA", AssetID: 1000, Amount: 1, TxID: "TXA", Round: 1200},
+		{NfdName: "b.algo", DepositAccount: "BBB", AssetID: 1000, Amount: 2, ErrorClass: ErrClassNotOptedIn, Error: errNotOptedIn},
+		{NfdName: "e.algo", DepositAccount: "EEE", AssetID: 1000, Amount: 5, ErrorClass: ErrClassLeaseInUse, Error: errLeaseInUse},
+		{NfdName: "f.algo", DepositAccount: "FFF", AssetID: 1000, Amount: 6, ErrorClass: ErrClassNetwork, Error: errNetwork},
+		{NfdName: "g.algo", DepositAccount: "GGG", SendToVault: true, AssetID: 1000, Amount: 7, ErrorClass: ErrClassNetwork, Error: errNfdGateway},
+		{NfdName: "h.algo", DepositAccount: "HHH", AssetID: 2000, Amount: 8, ErrorClass: ErrClassInsufficient, Error: errOverspend},
+		{NfdName: "i.algo", DepositAccount: "III", AssetID: 1000, Amount: 9, TxID: "TXLANDED", ErrorClass: ErrClassExpired, Error: errTimedOut},
+		// results don't record the last valid round - so a send still in the pool can't be known to be expired
+		{NfdName: "k.algo", DepositAccount: "KKK", AssetID: 1000, Amount: 11, TxID: "TXEXPIRED", ErrorClass: ErrClassExpired, Error: errTimedOut},
+		{NfdName: "l.algo", DepositAccount: "LLL", AssetID: 1000, Amount: 12, TxID: "TXGONE", ErrorClass: ErrClassExpired, Error: errTimedOut},
+	}
+	want := []string{"g.algo/1000/7", "h.algo/2000/8", "l.algo/1000/12"}
+
+	dir := t.TempDir()
+	jsonlFile, err := os.Create(filepath.Join(dir, "results.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvFile, err := os.Create(filepath.Join(dir, "results.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvWriter := csv.NewWriter(csvFile)
+	csvWriter.Write(resultsCsvHeader)
+	for _, record := range records {
+		record.RunID = testRunID
+		line, _ := json.Marshal(record)
+		jsonlFile.Write(append(line, '\n'))
+		csvWriter.Write(record.csvRow())
+	}
+	csvWriter.Flush()
+	jsonlFile.Close()
+	csvFile.Close()
+
+	for _, filename := range []string{jsonlFile.Name(), csvFile.Name()} {
+		t.Run(filepath.Ext(filename), func(t *testing.T) {
+			runID, plan, err := retryPlan(filename, testAssets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runID != testRunID {
+				t.Errorf("run id = %q, want %q", runID, testRunID)
+			}
+			if got := planSummary(plan); !slices.Equal(got, want) {
+				t.Errorf("retryPlan = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func jsonStr(val string) string {
+	b, _ := json.Marshal(val)
+	return string(b)
+}
@@ -5,27 +5,140 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
 )
 
 type BatchSendConfig struct {
 	Send SendChoice `json:"send"`
 
 	Destination DestinationChoice `json:"destination"`
+
+	Distribution DistributionChoice `json:"distribution"`
+
+	Fees FeeChoice `json:"fees"`
+
+	// Nodes optionally lists the algod endpoints to use (instead of ALGO_ALGOD_URL, etc.) - requests are spread
+	// across the healthy ones
+	Nodes []algo.NodeConfig `json:"nodes,omitempty"`
 }
 
 type SendChoice struct {
-	Asset struct {
-		ASA uint64 `json:"asa"`
-		// If IsPerRcp is NOT set then this is the TOTAL amount to send - and will be divided across destination
-		// count - if IsPerRcp is set then amount is amount per recipient
-		// Specified in user-friendly units - not base units - ie 1.5 ALGO would be 1.5, not 1,500,000
-		Amount float64 `json:"amount"`
-		// Is the amount 'per recipient' or is it total amount to send.
-		IsPerRecip bool `json:"isPerRecip"`
-		// what note to include with the transaction
-		Note string `json:"note,omitempty"`
-	} `json:"asset"`
+	// Asset is the original single-asset form.  Still supported - if specified it's treated as the first entry of Assets
+	Asset *AssetChoice `json:"asset,omitempty"`
+	// Assets is the list of assets to send to each recipient - each with its own amount/isPerRecip/note settings.
+	Assets []AssetChoice `json:"assets,omitempty"`
+	// Nfts switches to NFT distribution mode - each recipient receives exactly one distinct NFT out of a pool.
+	// Can't be combined with Asset/Assets.
+	Nfts *NftChoice `json:"nfts,omitempty"`
+	// TagNotes prefixes each transaction note with a machine-readable (ARC-2 json) tag identifying the run,
+	// recipient and asset - so sends (and any duplicates) can be found afterward.
+	TagNotes bool `json:"tagNotes,omitempty"`
+}
+
+type NftChoice struct {
+	// The pool of NFT ASA IDs to distribute
+	ASAs []uint64 `json:"asas,omitempty"`
+	// Or, an account whose created assets (held by the sender) become the pool
+	Creator string `json:"creator,omitempty"`
+	// How NFTs are assigned to recipients: "random" (default) or "ordered" (pool order matched to recipient order)
+	Assignment string `json:"assignment,omitempty"`
+	// File recipient->NFT assignments are saved to before sending, and reloaded from on re-runs so assignments
+	// stay the same.  Defaults to nft-assignments.csv next to the config file
+	AssignmentFile string `json:"assignmentFile,omitempty"`
+	// what note to include with the transaction
+	Note string `json:"note,omitempty"`
+}
+
+type AssetChoice struct {
+	ASA uint64 `json:"asa"`
+	// If IsPerRcp is NOT set then this is the TOTAL amount to send - and will be divided across destination
+	// count - if IsPerRcp is set then amount is amount per recipient
+	// Specified in user-friendly units - not base units - ie 1.5 ALGO would be 1.5, not 1,500,000
+	// It can't have more decimal places than the asset itself.
+	Amount Amount `json:"amount"`
+	// Is the amount 'per recipient' or is it total amount to send.
+	IsPerRecip bool `json:"isPerRecip"`
+	// what note to include with the transaction
+	Note string `json:"note,omitempty"`
+}
+
+// AssetChoices returns the combined list of assets to send - the single 'asset' entry (if specified) followed by
+// the entries in 'assets'.
+func (sc SendChoice) AssetChoices() []AssetChoice {
+	var choices []AssetChoice
+	if sc.Asset != nil {
+		choices = append(choices, *sc.Asset)
+	}
+	return append(choices, sc.Assets...)
+}
+
+// Fee policies
+const (
+	FeePolicyMin       = "min"
+	FeePolicySuggested = "suggested"
+)
+
+// FeeChoice determines the fee paid for each (directly built) transaction.
+type FeeChoice struct {
+	// min (default) always pays the minimum fee, suggested pays the fee suggested by the node - higher during
+	// congestion
+	Policy string `json:"policy,omitempty"`
+	// If set (in microAlgo), sending pauses whenever the fee per transaction would be higher - until it drops again
+	MaxFeePerTxn uint64 `json:"maxFeePerTxn,omitempty"`
+}
+
+func (fc FeeChoice) String() string {
+	policy := fc.Policy
+	if policy == "" {
+		policy = FeePolicyMin
+	}
+	if fc.MaxFeePerTxn != 0 {
+		return fmt.Sprintf("%s, max %d microAlgo per txn", policy, fc.MaxFeePerTxn)
+	}
+	return policy
+}
+
+// Distribution strategies
+const (
+	DistributeEqual          = "equal"
+	DistributeByHolding      = "byHolding"
+	DistributeBySegmentCount = "bySegmentCount"
+	DistributeByCsvColumn    = "csvColumn"
+)
+
+// Policies for recipients not opted-in to the asset being sent
+const (
+	NotOptedInSkip  = "skip"
+	NotOptedInVault = "vault"
+	NotOptedInFail  = "fail"
+)
+
+// DistributionChoice determines how a TOTAL amount (isPerRecip false) is shared across recipients.  Each
+// recipient gets a share proportional to its weight.
+type DistributionChoice struct {
+	// equal (default), byHolding, bySegmentCount, or csvColumn
+	Strategy string `json:"strategy"`
+	// byHolding: the ASA whose holdings (by the owner account of each recipient) are the weight
+	HoldingASA uint64 `json:"holdingAsa,omitempty"`
+	// csvColumn: name of the csv file column containing each rows weight
+	CsvColumn string `json:"csvColumn,omitempty"`
+}
+
+func (dc DistributionChoice) String() string {
+	switch dc.Strategy {
+	case DistributeByHolding:
+		return fmt.Sprintf("weighted by holdings of ASA:%d", dc.HoldingASA)
+	case DistributeBySegmentCount:
+		return "weighted by segment count"
+	case DistributeByCsvColumn:
+		return fmt.Sprintf("weighted by csv column:%s", dc.CsvColumn)
+	default:
+		return "equal"
+	}
 }
 
 type DestinationChoice struct {
@@ -35,6 +148,9 @@ type DestinationChoice struct {
 	// If it should only be sent to segments of specified Root
 	SegmentsOfRoot string `json:"segmentsOfRoot"`
 
+	// Send to every holder of an ASA (as of the current or a specific round) instead of NFDs
+	HolderSnapshot *HolderSnapshotChoice `json:"holderSnapshot,omitempty"`
+
 	// If RandomNFDs is filled out then target isn't 'all' it's random in some way
 	// so if SegmentsOfRoot is set but RandomNFDs.xxx isn't then it's all
 	RandomNFDs struct {
@@ -45,8 +161,16 @@ type DestinationChoice struct {
 	// Ignore segments, only pick roots
 	OnlyRoots bool `json:"onlyRoots"`
 
+	// Filters of the NFD search (for all NFDs, or segments of a root)
+	Search *NfdSearchChoice `json:"search,omitempty"`
+
 	SendToVaults bool `json:"sendToVaults"`
 
+	// What to do with recipients not opted-in to an asset when sending directly to their account (sendToVaults false):
+	// skip (default) drops them from the send, vault sends to their NFD vault instead (if it can receive), fail
+	// stops before anything is sent.
+	NotOptedIn string `json:"notOptedIn,omitempty"`
+
 	// Whether to limit the send to only those NFDs that have a version between these two numbers (each optional)
 	MinMajorVersion int `json:"minMajorVersion"`
 	MaxMajorVersion int `json:"maxMajorVersion"`
@@ -54,11 +178,76 @@ type DestinationChoice struct {
 	// Only send if v.XXXX is present in NFD (ie: verifiedRequirements: ["twitter"] would require v.twitter to be set)
 	VerifiedRequirements []string `json:"verifiedRequirements,omitempty"`
 
+	// Only send to NFDs whose owner (and optionally caAlgo accounts) hold the specified assets - ie: token gating
+	HoldsAssets *HoldsAssetsChoice `json:"holdsAssets,omitempty"`
+
+	// If specified, only recipients in the include list are sent to - and never those in the exclude list (ie: treasury,
+	// team wallets, exchanges)
+	Include *RecipientListChoice `json:"include,omitempty"`
+	Exclude *RecipientListChoice `json:"exclude,omitempty"`
+
 	// If user w/ single account owns 10 eligible NFDS do they get 10 drops or just 1.  Defaults to just going to
 	// unique owner accounts.  Leave as false (default) to send '1' per nfd regardless
 	AllowDuplicateAccounts bool `json:"allowDuplicateAccounts"`
 }
 
+// NfdSearchChoice are the filters of the NFD API search, passed through as-is - each optional, and single valued
+type NfdSearchChoice struct {
+	// curated, premium, or common
+	Category string `json:"category,omitempty"`
+	// 1_letters .. 9_letters, or 10+_letters
+	Length string `json:"length,omitempty"`
+	// emoji, pristine, or segment
+	Traits string `json:"traits,omitempty"`
+	// Name starts with / contains
+	Prefix    string `json:"prefix,omitempty"`
+	Substring string `json:"substring,omitempty"`
+	// Verified property (ie: twitter) and optionally the value it has to have
+	VProperty string `json:"vproperty,omitempty"`
+	VValue    string `json:"vvalue,omitempty"`
+	// Whether segments of the NFD have to be locked (or unlocked), and whether it has to be a segment root
+	SegmentLocked *bool `json:"segmentLocked,omitempty"`
+	SegmentRoot   *bool `json:"segmentRoot,omitempty"`
+	// Only NFDs changed after this date (YYYY-MM-DD) or time (RFC3339)
+	ChangedAfter string `json:"changedAfter,omitempty"`
+}
+
+func (sc NfdSearchChoice) String() string {
+	var filters []string
+	add := func(name string, value string) {
+		if value != "" {
+			filters = append(filters, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	add("category", sc.Category)
+	add("length", sc.Length)
+	add("traits", sc.Traits)
+	add("prefix", sc.Prefix)
+	add("substring", sc.Substring)
+	add("vproperty", sc.VProperty)
+	add("vvalue", sc.VValue)
+	if sc.SegmentLocked != nil {
+		add("segmentLocked", fmt.Sprint(*sc.SegmentLocked))
+	}
+	if sc.SegmentRoot != nil {
+		add("segmentRoot", fmt.Sprint(*sc.SegmentRoot))
+	}
+	add("changedAfter", sc.ChangedAfter)
+	return strings.Join(filters, ", ")
+}
+
+// changedAfter parses the ChangedAfter date (or time)
+func (sc NfdSearchChoice) changedAfter() (time.Time, error) {
+	if changed, err := time.Parse(time.DateOnly, sc.ChangedAfter); err == nil {
+		return changed, nil
+	}
+	changed, err := time.Parse(time.RFC3339, sc.ChangedAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid search changedAfter:%s, must be YYYY-MM-DD or an RFC3339 time", sc.ChangedAfter)
+	}
+	return changed, nil
+}
+
 func (dc DestinationChoice) String() string {
 	var sb strings.Builder
 	if dc.CsvFile != "" {
@@ -70,16 +259,34 @@ func (dc DestinationChoice) String() string {
 	if dc.SegmentsOfRoot != "" {
 		sb.WriteString(fmt.Sprintf("Segments of root:%s, ", dc.SegmentsOfRoot))
 	}
+	if dc.HolderSnapshot != nil {
+		sb.WriteString(fmt.Sprintf("Holders of ASA:%d, ", dc.HolderSnapshot.ASA))
+	}
 	if dc.OnlyRoots {
 		sb.WriteString(fmt.Sprintf("Grabbing 'roots' only, "))
 	}
+	if !dc.SendToVaults && dc.NotOptedIn != "" {
+		sb.WriteString(fmt.Sprintf("Not opted-in:%s, ", dc.NotOptedIn))
+	}
 	if dc.RandomNFDs.Count != 0 {
 		sb.WriteString(fmt.Sprintf("Limited to maximum of %d recipients", dc.RandomNFDs.Count))
 	}
 	if len(dc.VerifiedRequirements) > 0 {
 		sb.WriteString(fmt.Sprintf("Verified (v.*) requirements: %v, ", dc.VerifiedRequirements))
 	}
-	if dc.SegmentsOfRoot == "" && !dc.OnlyRoots && dc.RandomNFDs.Count == 0 && len(dc.VerifiedRequirements) == 0 {
+	if dc.Search != nil {
+		sb.WriteString(fmt.Sprintf("Search: %s, ", dc.Search))
+	}
+	if dc.HoldsAssets != nil {
+		sb.WriteString(fmt.Sprintf("Holding %s, ", dc.HoldsAssets))
+	}
+	if dc.Include != nil {
+		sb.WriteString(fmt.Sprintf("Including only: %s, ", dc.Include))
+	}
+	if dc.Exclude != nil {
+		sb.WriteString(fmt.Sprintf("Excluding: %s, ", dc.Exclude))
+	}
+	if dc.HolderSnapshot == nil && dc.SegmentsOfRoot == "" && dc.Search == nil && !dc.OnlyRoots && dc.RandomNFDs.Count == 0 && len(dc.VerifiedRequirements) == 0 && dc.HoldsAssets == nil {
 		sb.WriteString("Sending to ALL owned (matching) NFDs")
 	}
 	return sb.String()
@@ -100,6 +307,10 @@ func loadJSONConfig(filename string) (*BatchSendConfig, error) {
 	if err := json.Unmarshal(fileBytes, &data); err != nil {
 		return nil, err
 	}
+	if data.Send.Nfts != nil && data.Send.Nfts.AssignmentFile == "" {
+		// kept with the config it's for - so re-runs find it wherever they're run from
+		data.Send.Nfts.AssignmentFile = filepath.Join(filepath.Dir(filename), defaultNftAssignmentFile)
+	}
 
 	return &data, nil
 }
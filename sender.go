@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
@@ -18,11 +21,19 @@ import (
 	nfdapi "github.com/TxnLab/batch-asset-send/lib/nfdapi/swagger"
 )
 
+// how often progress (with the current rates of algod and the NFD API) is reported while sending
+const progressInterval = 10 * time.Second
+
 // RecipientTransaction is for tracking what was sent or what was meant to be sent to each recipient
 type RecipientTransaction struct {
 	sendAsset       *SendAsset
 	baseUnitsToSend uint64
 	recip           *Recipient
+	fee             uint64 // total fee of the txns of the send
+	// txid of the send once it's been submitted - kept if it then fails, as it may still have landed
+	submittedTxID string
+	// stopped before it could be (re)sent - it has no result, and is left for -resume
+	unsent bool
 	// Either has an error on its send or success
 	Error   error
 	Success struct {
@@ -31,6 +42,14 @@ type RecipientTransaction struct {
 	}
 }
 
+// txid returns the txid of the send - confirmed, or submitted but failed (and of unknown outcome)
+func (rt *RecipientTransaction) txid() string {
+	if rt.Success.txid != "" {
+		return rt.Success.txid
+	}
+	return rt.submittedTxID
+}
+
 func (rt *RecipientTransaction) String() string {
 	if rt == nil {
 		return "{nil}"
@@ -47,6 +66,9 @@ func (rt *RecipientTransaction) String() string {
 		rt.sendAsset.formattedAmount(rt.baseUnitsToSend)))
 	if rt.Error != nil {
 		retStr.WriteString(fmt.Sprintf("Error: %v", rt.Error))
+		if rt.submittedTxID != "" {
+			retStr.WriteString(fmt.Sprintf(" (submitted as TxID %s - may have landed)", rt.submittedTxID))
+		}
 	}
 	if rt.Success.round != 0 {
 		retStr.WriteString(fmt.Sprintf("Success: Round %d, TxID %s", rt.Success.round, rt.Success.txid))
@@ -64,7 +86,20 @@ type SendRequest struct {
 	note             string
 }
 
-func sendAssets(sender string, send []*SendAsset, recipients []*Recipient, vaultNfd *nfdapi.NfdRecord, dryRun bool) {
+// txnNote returns the note to put on the transaction for this send
+func (sr *SendRequest) txnNote() string {
+	if sendConfig.Send.TagNotes {
+		return taggedNote(runID, &sr.recipient, sr.asset.AssetID, sr.asset.Note)
+	}
+	return sr.asset.Note
+}
+
+// isDirect returns true if neither side of the send is a vault - so it's a plain transfer we build ourselves
+func (sr *SendRequest) isDirect() bool {
+	return sr.sendFromVaultNFD == nil && !sr.recipient.SendToVault
+}
+
+func sendAssets(sender string, send []*SendAsset, plan []*PlannedSend, vaultNfd *nfdapi.NfdRecord, journal *SendJournal, results *ResultsFile, dryRun bool, stopping <-chan struct{}) {
 	var (
 		sendRequests = make(chan SendRequest, maxSimultaneousSends)
 		sendResults  = make(chan *RecipientTransaction, maxSimultaneousSends)
@@ -72,55 +107,178 @@ func sendAssets(sender string, send []*SendAsset, recipients []*Recipient, vault
 		wg           sync.WaitGroup
 		successes    int
 		failures     int
+		assetTotals  = map[uint64]*[2]int{} // per asset: [successes, failures]
+		completed    = map[string]bool{}    // journal keys of sends with a result
 		startTime    = time.Now()
+		lastProgress = time.Now()
 	)
 	// ensure file appending is possible
-	appendToFile("Starting", "failure.txt")
-	appendToFile("Starting", "success.txt")
+	appendToFile("Starting", filepath.Join(runDir, "failure.txt"))
+	appendToFile("Starting", filepath.Join(runDir, "success.txt"))
 
 	// Queues to sendRequests then closes the channel once done
-	go QueueSends(sendRequests, send, sender, recipients, vaultNfd)
+	go QueueSends(sendRequests, plan, sender, vaultNfd, stopping)
 
 	// Handle parallel results that will soon be coming from the parallel sends - exiting once handled all sends...
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		for _, asset := range send {
+			assetTotals[asset.AssetID] = &[2]int{}
+		}
 		for result := range sendResults {
+			if result.unsent {
+				if !dryRun {
+					journal.recordUnsent(result)
+				}
+				continue
+			}
 			misc.Infof(logger, "Send result:%s", result.String())
+			totals := assetTotals[result.sendAsset.AssetID]
+			completed[journalKey(result.recip, result.sendAsset.AssetID)] = true
+			if !dryRun {
+				journal.recordResult(result)
+			}
+			results.record(result)
 			// save off to separate files - success, failure - opening/closing each to allow for clean
 			// exit
 			if result.Error != nil {
-				appendToFile(result.String(), "failure.txt")
+				appendToFile(result.String(), filepath.Join(runDir, "failure.txt"))
 				failures++
+				totals[1]++
 			} else {
-				appendToFile(result.String(), "success.txt")
+				appendToFile(result.String(), filepath.Join(runDir, "success.txt"))
 				successes++
+				totals[0]++
+			}
+			if time.Since(lastProgress) >= progressInterval {
+				lastProgress = time.Now()
+				misc.Infof(logger, "Progress: %d of %d sends done (%d failed) - %s, %s",
+					successes+failures, len(plan), failures, algodThrottle, nfdThrottle)
 			}
 		}
 	}()
 
-	// Now handle all the send requests (in parallel fanout)
+	// Now handle all the send requests (in parallel fanout) - direct sends being batched into groups if enabled
+	var group []SendRequest
+	sendGroup := func() {
+		fanOut.Run(func(val any) error {
+			algodThrottle.acquire()
+			defer algodThrottle.release()
+			for _, result := range sendGroupToRecipients(sender, val.([]SendRequest), journal, stopping) {
+				sendResults <- result
+			}
+			return nil
+		}, group)
+		group = nil
+	}
 	for send := range sendRequests {
+		if isStopping(stopping) {
+			// already queued, but not started - left unsent
+			continue
+		}
+		if groupSize > 1 && !dryRun && send.isDirect() {
+			if group = append(group, send); len(group) == groupSize {
+				sendGroup()
+			}
+			continue
+		}
 		fanOut.Run(func(val any) error {
 			sendReq := val.(SendRequest)
+			// the fanout is the most sends at once - the throttle lowers it while the node is rate limiting
+			algodThrottle.acquire()
+			defer algodThrottle.release()
 			misc.Infof(logger, "  %s: %s", sendReq.recipient.DepositAccount, sendReq.recipient.NfdName)
-			sendResults <- sendAssetToRecipient(sender, &sendReq, dryRun)
+			sendResults <- sendAssetToRecipient(sender, &sendReq, journal, dryRun, stopping)
 			return nil
 		}, send)
 	}
+	if len(group) > 0 && !isStopping(stopping) {
+		sendGroup()
+	}
 	fanOut.Wait()      // returns once all results are queued..
 	close(sendResults) // we've queued all results at this point
 	wg.Wait()          // now wait to have processed them all.
 
 	if failures > 0 {
 		misc.Infof(logger, "%d successful sends", successes)
-		misc.Infof(logger, "%d FAILED sends - check failure.txt for issues", failures)
+		misc.Infof(logger, "%d FAILED sends - check %s for issues", failures, filepath.Join(runDir, "failure.txt"))
 	} else {
 		misc.Infof(logger, "All %d sends successful", successes)
 	}
+	if len(send) > 1 && sendConfig.Send.Nfts == nil {
+		for _, asset := range send {
+			totals := assetTotals[asset.AssetID]
+			misc.Infof(logger, "  Asset %d (%s): %d successful, %d failed", asset.AssetID, asset.AssetParams.UnitName, totals[0], totals[1])
+		}
+	}
+	if isStopping(stopping) {
+		reportUnsent(plan, completed, journal)
+	}
 	misc.Infof(logger, "Elapsed time:%v", time.Since(startTime))
 }
 
+// handleShutdownSignals returns a channel that's closed once an interrupt (or terminate) signal is received - so
+// no new sends are started, while those in progress are still waited on and their results recorded.  A second
+// signal cancels ctx, aborting whatever is still waiting (on confirmations, the node, or rate limits) so the run
+// winds down with what it knows, and a third exits immediately.
+func handleShutdownSignals() <-chan struct{} {
+	var (
+		stopping = make(chan struct{})
+		signals  = make(chan os.Signal, 1)
+	)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		misc.Infof(logger, "Received %s - stopping once sends in progress complete (repeat to abort them)", sig)
+		close(stopping)
+		sig = <-signals
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		misc.Infof(logger, "Received %s - aborting sends in progress, their outcome is left for -resume to check (repeat to exit immediately)", sig)
+		cancelCtx()
+	}()
+	return stopping
+}
+
+func isStopping(stopping <-chan struct{}) bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportUnsent summarizes the planned sends that were never started because of a shutdown - listing each in
+// unsent.txt in the run directory.
+func reportUnsent(plan []*PlannedSend, completed map[string]bool, journal *SendJournal) {
+	var (
+		filename = filepath.Join(runDir, "unsent.txt")
+		unsent   = map[uint64]int{}
+		total    int
+	)
+	for _, send := range plan {
+		if completed[journalKey(send.recipient, send.asset.AssetID)] {
+			continue
+		}
+		appendToFile(fmt.Sprintf("Recipient: %s (%s), Asset ID: %d, Amount: %s", send.recipient.NfdName,
+			send.recipient.DepositAccount, send.asset.AssetID, send.asset.formattedAmount(send.amount)), filename)
+		unsent[send.asset.AssetID]++
+		total++
+	}
+	if total == 0 {
+		misc.Infof(logger, "Stopped early, but all sends were completed")
+		return
+	}
+	misc.Infof(logger, "Stopped early - %d sends NOT sent, listed in %s", total, filename)
+	for assetID, count := range unsent {
+		misc.Infof(logger, "  Asset %d: %d not sent", assetID, count)
+	}
+	if journal != nil {
+		misc.Infof(logger, "Send them with: -resume %s", journal.filename)
+	}
+}
+
 func appendToFile(message string, filename string) {
 	// open file in append mode
 	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
@@ -138,43 +296,38 @@ func appendToFile(message string, filename string) {
 	}
 }
 
-func QueueSends(sendRequests chan SendRequest, sendAsset []*SendAsset, sender string, recipients []*Recipient, sendFromVaultNFD *nfdapi.NfdRecord) {
+func QueueSends(sendRequests chan SendRequest, plan []*PlannedSend, sender string, sendFromVaultNFD *nfdapi.NfdRecord, stopping <-chan struct{}) {
 	var (
 		// Get new params every 30 secs or so
-		txParams = algo.SuggestedParams(ctx, logger, algoClient)
+		txParams = sendParams(stopping)
 		ticker   = time.NewTicker(30 * time.Second)
 	)
-	for _, asset := range sendAsset {
-		var amount float64
-		if asset.IsAmountPerRecip {
-			amount = asset.AmountToSend
-		} else {
-			amount = asset.AmountToSend / float64(len(recipients))
+	for _, send := range plan {
+		if isStopping(stopping) {
+			break
 		}
-		baseUnitAmount := asset.amountInBaseUnits(amount)
-		misc.Infof(logger, "Sending %s of asset %d to %d recipients", asset.formattedAmount(baseUnitAmount), asset.AssetID, len(recipients))
-
-		for _, recipient := range recipients {
-			select {
-			case <-ticker.C:
-				txParams = algo.SuggestedParams(ctx, logger, algoClient)
-			default:
-			}
-			// just queue the request to send
-			sendRequests <- SendRequest{
-				sender:           sender,
-				params:           txParams,
-				asset:            *asset,
-				amount:           baseUnitAmount,
-				recipient:        *recipient,
-				sendFromVaultNFD: sendFromVaultNFD,
-			}
+		select {
+		case <-ticker.C:
+			// pauses here while fees are above the cap
+			txParams = sendParams(stopping)
+		default:
+		}
+		// just queue the request to send
+		sendRequests <- SendRequest{
+			sender:           sender,
+			params:           txParams,
+			asset:            *send.asset,
+			amount:           send.amount,
+			recipient:        *send.recipient,
+			sendFromVaultNFD: sendFromVaultNFD,
 		}
 	}
 	close(sendRequests)
 }
 
-func sendAssetToRecipient(sender string, sendReq *SendRequest, dryRun bool) *RecipientTransaction {
+// sendAssetToRecipient sends the asset to the recipient, resubmitting it (with fresh params) if it expires unsent -
+// unless stopping is closed, in which case it's left unsent.
+func sendAssetToRecipient(sender string, sendReq *SendRequest, journal *SendJournal, dryRun bool, stopping <-chan struct{}) *RecipientTransaction {
 	var sendFromVaultName string
 
 	retReceipt := &RecipientTransaction{
@@ -193,44 +346,112 @@ func sendAssetToRecipient(sender string, sendReq *SendRequest, dryRun bool) *Rec
 	if sendReq.recipient.SendToVault {
 		recipAsString = sendReq.recipient.NfdName
 	}
-	if dryRun {
-		senderStr := sender
-		if sendFromVaultName != "" {
-			senderStr = sendFromVaultName + " vault"
+	for attempt := 1; ; attempt++ {
+		txnId, signedBytes, err := getAssetSendTxns(
+			sender,
+			sendFromVaultName,
+			recipAsString,
+			sendReq.recipient.SendToVault,
+			sendReq.asset.AssetID,
+			sendReq.amount,
+			sendReq.txnNote(),
+			sendLease(runID, &sendReq.recipient, sendReq.asset.AssetID),
+			sendReq.params,
+		)
+		if err != nil {
+			retReceipt.Error = fmt.Errorf("failure getting txns: %w", err)
+			return retReceipt
+		}
+		retReceipt.fee = txnsFee(signedBytes)
+		if dryRun {
+			// Evaluate the real (signed) txns against the current ledger - without sending anything
+			senderStr := sender
+			if sendFromVaultName != "" {
+				senderStr = sendFromVaultName + " vault"
+			}
+			retReceipt.Error = simulateSend(signedBytes, fmt.Sprintf("%s of %s from %s to %s",
+				sendReq.asset.formattedAmount(sendReq.amount), sendReq.asset.AssetParams.UnitName, senderStr, recipAsString))
+			return retReceipt
+		}
+
+		// Vault sends are built by the NFD API with its own params - so the validity window comes from the txns
+		firstValid, lastValid, err := txnsValidity(signedBytes)
+		if err != nil {
+			retReceipt.Error = fmt.Errorf("failure getting txns: %w", err)
+			return retReceipt
+		}
+		// Journal it before it's sent - if we die after sending, a resume will check if it made it
+		journal.recordSubmitted(sendReq, txnId, lastValid)
+		var pendResponse models.PendingTransactionInfoResponse
+		if _, err = sendTxns(signedBytes); err == nil {
+			retReceipt.submittedTxID = txnId
+			pendResponse, err = waitForTxn(txnId, lastValid-firstValid)
+		}
+		if err == nil {
+			retReceipt.Success.round = pendResponse.ConfirmedRound
+			retReceipt.Success.txid = txnId
+			return retReceipt
+		}
+		if !isExpired(err) || attempt >= maxSendAttempts {
+			retReceipt.Error = fmt.Errorf("waiting for txn: %w", err)
+			return retReceipt
+		}
+		// Its validity window passed - either before it was sent (sat in the queue too long) or without it being
+		// confirmed.  Only build it again (w/ fresh params) once sure it didn't land.
+		landedRound, checkErr := expiredSendLanded(txnId, lastValid)
+		if checkErr != nil {
+			retReceipt.Error = fmt.Errorf("txn expired (%w) and unable to determine if it landed: %w", err, checkErr)
+			return retReceipt
+		}
+		if landedRound != 0 {
+			retReceipt.Success.round = landedRound
+			retReceipt.Success.txid = txnId
+			return retReceipt
+		}
+		retReceipt.submittedTxID = ""
+		if isStopping(stopping) {
+			misc.Infof(logger, "..send to %s expired unsent (%v), stopping so not resubmitting", sendReq.recipient.NfdName, err)
+			retReceipt.unsent = true
+			return retReceipt
+		}
+		misc.Infof(logger, "..send to %s expired unsent (%v), resubmitting - attempt %d of %d", sendReq.recipient.NfdName, err, attempt+1, maxSendAttempts)
+		if sendReq.params = sendParams(stopping); isStopping(stopping) {
+			// stopped while paused for fees
+			retReceipt.unsent = true
+			return retReceipt
 		}
-		misc.Infof(logger, "DryRun: Would send %s of %s from %s to %s", sendReq.asset.formattedAmount(sendReq.amount), sendReq.asset.AssetParams.UnitName, senderStr, recipAsString)
-		return retReceipt
 	}
+}
 
-	txnId, signedBytes, err := getAssetSendTxns(
-		sender,
-		sendFromVaultName,
-		recipAsString,
-		sendReq.recipient.SendToVault,
-		sendReq.asset.AssetID,
-		sendReq.amount,
-		sendReq.asset.Note,
-		sendReq.params,
+// simulateSend runs the signed txns of a send through algod simulate, logging whether it would succeed (with its
+// fees and number of inner txns) and returning the reason it would fail if not.
+func simulateSend(signedBytes []byte, description string) error {
+	var (
+		result models.SimulateTransactionGroupResult
+		err    error
 	)
+	err = retryAlgoCalls(func() error {
+		result, err = algo.SimulateTxns(ctx, algoClient, signedBytes)
+		return err
+	})
 	if err != nil {
-		retReceipt.Error = fmt.Errorf("failure getting txns: %w", err)
-		return retReceipt
+		return fmt.Errorf("unable to simulate: %w", err)
 	}
-
-	pendResponse, err := sendAndWaitTxns(signedBytes, uint64(sendReq.params.LastRoundValid-sendReq.params.FirstRoundValid))
-	if err != nil {
-		retReceipt.Error = fmt.Errorf("waiting for txn: %w", err)
-		return retReceipt
+	fees, numInner := algo.SimulatedFees(result)
+	if result.FailureMessage != "" {
+		misc.Infof(logger, "DryRun: Sending %s would FAIL: %s", description, result.FailureMessage)
+		return fmt.Errorf("simulated send failed at txn %v: %s", result.FailedAt, result.FailureMessage)
 	}
-	retReceipt.Success.round = pendResponse.ConfirmedRound
-	retReceipt.Success.txid = txnId
-	return retReceipt
+	misc.Infof(logger, "DryRun: Sending %s would succeed - %d txns, %d inner txns, fees:%s ALGO",
+		description, len(result.TxnResults), numInner, algo.FormattedAlgoAmount(fees))
+	return nil
 }
 
-func sendAndWaitTxns(txnBytes []byte, waitRounds uint64) (models.PendingTransactionInfoResponse, error) {
+// sendTxns submits the signed txn (or group), returning the txid of the first - any error means the node
+// rejected it, so nothing was sent.
+func sendTxns(txnBytes []byte) (string, error) {
 	var (
 		txid string
-		resp models.PendingTransactionInfoResponse
 		err  error
 	)
 	err = retryAlgoCalls(func() error {
@@ -238,30 +459,56 @@ func sendAndWaitTxns(txnBytes []byte, waitRounds uint64) (models.PendingTransact
 		return err
 	})
 	if err != nil {
-		return models.PendingTransactionInfoResponse{}, fmt.Errorf("sendAndWaitTxns failed to send txns: %w", err)
+		if strings.Contains(err.Error(), "overlapping lease") {
+			return "", fmt.Errorf("sendTxns rejected as an earlier copy of this send (same lease) is still valid and may have already been sent: %w", err)
+		}
+		return "", fmt.Errorf("sendTxns failed to send txns: %w", err)
 	}
+	return txid, nil
+}
 
+func waitForTxn(txid string, waitRounds uint64) (models.PendingTransactionInfoResponse, error) {
+	var (
+		resp models.PendingTransactionInfoResponse
+		err  error
+	)
 	err = retryAlgoCalls(func() error {
 		resp, err = transaction.WaitForConfirmation(algoClient, txid, waitRounds, ctx)
 		return err
 	})
 	if err != nil {
-		return models.PendingTransactionInfoResponse{}, fmt.Errorf("sendAndWaitTxns failure in confirmation wait: %w", err)
+		return models.PendingTransactionInfoResponse{}, fmt.Errorf("waitForTxn failure in confirmation wait: %w", err)
 	}
 	return resp, nil
 }
 
+// isAlgoNotFound returns true if the algod call failed because the item (account holding, txn, etc.) wasn't found
+func isAlgoNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "404")
+}
+
+// retryAlgoCalls makes the algod call (through the shared algod throttle), retrying it if the node is
+// overloaded or rate limiting - backing off the throttle when it's told to.
 func retryAlgoCalls(meth func() error) error {
 	return repeat.Repeat(
 		repeat.Fn(func() error {
+			if err := algodThrottle.wait(); err != nil {
+				return repeat.HintStop(err)
+			}
 			err := meth()
 			if err != nil {
 				errStr := err.Error()
-				if strings.Contains(errStr, "429") || strings.Contains(errStr, "502") || strings.Contains(errStr, "503") {
+				if strings.Contains(errStr, "429") || strings.Contains(errStr, "503") {
+					algodThrottle.rateLimited(0)
+					return repeat.HintTemporary(err)
+				}
+				if strings.Contains(errStr, "502") {
 					return repeat.HintTemporary(err)
 				}
+				return err
 			}
-			return err
+			algodThrottle.succeeded()
+			return nil
 		}),
 		repeat.StopOnSuccess(),
 		repeat.WithDelay(repeat.ExponentialBackoff(1*time.Second).Set()),
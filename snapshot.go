@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+	"github.com/antihax/optional"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+	nfdapi "github.com/TxnLab/batch-asset-send/lib/nfdapi/swagger"
+)
+
+// max addresses per NfdGetLookup call
+const nfdLookupBatchSize = 20
+
+// HolderSnapshotChoice makes every holder of an ASA (as of the current, or a specific round) a recipient
+type HolderSnapshotChoice struct {
+	ASA uint64 `json:"asa"`
+	// The round to take the snapshot at - the current round if not specified.  Earlier rounds need an indexer
+	// that supports historical account searches.
+	Round uint64 `json:"round,omitempty"`
+	// Holders with less than this (in display units) are excluded - holders of any non-zero amount are included
+	// if not specified
+	MinBalance      Amount `json:"minBalance"`
+	ExcludeCreator  bool   `json:"excludeCreator,omitempty"`
+	ExcludeReserve  bool   `json:"excludeReserve,omitempty"`
+	ExcludeClawback bool   `json:"excludeClawback,omitempty"`
+	// File the snapshot is saved to, and reloaded from on re-runs so the same holders are used.  Defaults to
+	// holders-<asa>.csv
+	SnapshotFile string `json:"snapshotFile,omitempty"`
+}
+
+// snapshotSettings are what a holder snapshot was taken with - saved with it so it's only reused for the same
+// configuration
+type snapshotSettings struct {
+	asa        uint64
+	round      uint64
+	minBalance string // as configured, in display units
+	exclude    string // the excluded asset accounts, ie: creator;reserve
+}
+
+func (hc *HolderSnapshotChoice) settings() snapshotSettings {
+	var exclude []string
+	if hc.ExcludeCreator {
+		exclude = append(exclude, "creator")
+	}
+	if hc.ExcludeReserve {
+		exclude = append(exclude, "reserve")
+	}
+	if hc.ExcludeClawback {
+		exclude = append(exclude, "clawback")
+	}
+	return snapshotSettings{asa: hc.ASA, round: hc.Round, minBalance: hc.MinBalance.String(), exclude: strings.Join(exclude, ";")}
+}
+
+// checkSnapshotSettings makes sure a saved snapshot was taken with the configured settings
+func checkSnapshotSettings(choice *HolderSnapshotChoice, saved snapshotSettings, filename string) error {
+	configured := choice.settings()
+	switch {
+	case saved.asa != configured.asa:
+		return fmt.Errorf("holder snapshot %s is of ASA:%d, not the configured ASA:%d - remove it to take a new snapshot", filename, saved.asa, configured.asa)
+	case configured.round != 0 && saved.round != configured.round:
+		return fmt.Errorf("holder snapshot %s is as of round %d, not the configured round %d - remove it to take a new snapshot", filename, saved.round, configured.round)
+	case saved.minBalance != configured.minBalance:
+		return fmt.Errorf("holder snapshot %s was taken with minBalance:%s, not the configured %s - remove it to take a new snapshot", filename, saved.minBalance, configured.minBalance)
+	case saved.exclude != configured.exclude:
+		return fmt.Errorf("holder snapshot %s was taken excluding [%s], not the configured [%s] - remove it to take a new snapshot", filename, saved.exclude, configured.exclude)
+	}
+	return nil
+}
+
+// assetHolder is a holder (and their balance in base units) of the snapshot asset
+type assetHolder struct {
+	account string
+	balance uint64
+}
+
+// getSnapshotNfds returns a (synthetic) NFD record for every holder of the snapshot asset - like the account rows
+// of csv files, enriched with the NFD of each holder if they have one.
+func getSnapshotNfds(choice *HolderSnapshotChoice) ([]*nfdapi.NfdRecord, error) {
+	snapshotFile := choice.SnapshotFile
+	if snapshotFile == "" {
+		snapshotFile = fmt.Sprintf("holders-%d.csv", choice.ASA)
+	}
+	holders, saved, err := loadHolderSnapshot(snapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	if holders != nil {
+		if err = checkSnapshotSettings(choice, saved, snapshotFile); err != nil {
+			return nil, err
+		}
+		misc.Infof(logger, "..loaded %d holders of ASA:%d (as of round %d) from %s - remove it to take a new snapshot", len(holders), choice.ASA, saved.round, snapshotFile)
+	} else {
+		var round uint64
+		if holders, round, err = takeHolderSnapshot(choice); err != nil {
+			return nil, err
+		}
+		settings := choice.settings()
+		settings.round = round
+		if err = saveHolderSnapshot(snapshotFile, holders, settings); err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]*nfdapi.NfdRecord, 0, len(holders))
+	for _, holder := range holders {
+		records = append(records, accountNfdRecord(holder.account))
+	}
+	if nfdEnabled() {
+		resolved, err := enrichWithNfds(records, "brief", map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		misc.Infof(logger, "..%d of %d holders have an NFD", len(resolved), len(records))
+	}
+	return records, nil
+}
+
+// takeHolderSnapshot fetches every holder of the asset from the indexer - excluding the asset's own accounts and
+// small holders as configured.
+func takeHolderSnapshot(choice *HolderSnapshotChoice) ([]assetHolder, uint64, error) {
+	if indexerClient == nil {
+		return nil, 0, errors.New("a holder snapshot needs an indexer (ALGO_INDEXER_URL)")
+	}
+	assetInfo, err := algoClient.GetAssetByID(choice.ASA).Do(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching snapshot asset:%d, err:%w", choice.ASA, err)
+	}
+	minBalance, err := choice.MinBalance.BaseUnits(assetInfo.Params.Decimals)
+	if err != nil {
+		return nil, 0, fmt.Errorf("holderSnapshot minBalance, err:%w", err)
+	}
+	minBalance = max(minBalance, 1)
+	excluded := map[string]string{}
+	if choice.ExcludeCreator {
+		excluded[assetInfo.Params.Creator] = "creator"
+	}
+	if choice.ExcludeReserve && assetInfo.Params.Reserve != "" {
+		excluded[assetInfo.Params.Reserve] = "reserve"
+	}
+	if choice.ExcludeClawback && assetInfo.Params.Clawback != "" {
+		excluded[assetInfo.Params.Clawback] = "clawback"
+	}
+
+	misc.Infof(logger, "..taking snapshot of holders of ASA:%d (%s)", choice.ASA, assetInfo.Params.UnitName)
+	var (
+		holders   []assetHolder
+		round     uint64
+		nextToken string
+		numSmall  int
+		numPages  int
+	)
+	addHolder := func(account string, balance uint64) {
+		if reason, found := excluded[account]; found {
+			misc.Infof(logger, "..excluding %s account %s", reason, account)
+			return
+		}
+		if balance < minBalance {
+			numSmall++
+			return
+		}
+		holders = append(holders, assetHolder{account: account, balance: balance})
+	}
+	for {
+		if choice.Round == 0 {
+			var resp models.AssetBalancesResponse
+			err = retryAlgoCalls(func() error {
+				resp, err = indexerClient.LookupAssetBalances(choice.ASA).CurrencyGreaterThan(minBalance - 1).Limit(1000).NextToken(nextToken).Do(ctx)
+				return err
+			})
+			if err != nil {
+				return nil, 0, fmt.Errorf("error fetching holders of ASA:%d, err:%w", choice.ASA, err)
+			}
+			if round == 0 {
+				round = resp.CurrentRound
+			}
+			for _, balance := range resp.Balances {
+				addHolder(balance.Address, balance.Amount)
+			}
+			nextToken = resp.NextToken
+			if len(resp.Balances) == 0 {
+				break
+			}
+		} else {
+			var resp models.AccountsResponse
+			err = retryAlgoCalls(func() error {
+				resp, err = indexerClient.SearchAccounts().AssetID(choice.ASA).Round(choice.Round).
+					CurrencyGreaterThan(minBalance - 1).Limit(1000).NextToken(nextToken).Do(ctx)
+				return err
+			})
+			if err != nil {
+				return nil, 0, fmt.Errorf("error fetching holders of ASA:%d as of round %d, err:%w", choice.ASA, choice.Round, err)
+			}
+			round = choice.Round
+			for _, account := range resp.Accounts {
+				for _, holding := range account.Assets {
+					if holding.AssetId == choice.ASA {
+						addHolder(account.Address, holding.Amount)
+					}
+				}
+			}
+			nextToken = resp.NextToken
+			if len(resp.Accounts) == 0 {
+				break
+			}
+		}
+		if nextToken == "" {
+			break
+		}
+		if numPages++; numPages%10 == 0 {
+			misc.Infof(logger, "..%d holders so far", len(holders))
+		}
+	}
+	misc.Infof(logger, "..%d holders of ASA:%d as of round %d (%d excluded below the min balance)", len(holders), choice.ASA, round, numSmall)
+	return holders, round, nil
+}
+
+// enrichWithNfds resolves the (synthetic) records of bare accounts to their primary NFD (the NFD having the account
+// as a verified address) - taking its name, vault, and properties so vault sends and NFD filters work for them.
+// Direct sends still go to the account itself.  An NFD can have several of the accounts as verified addresses, so
+// only the first is given it - named holds the NFD names already in use.  Returns the NFD name each resolved account
+// was given.
+func enrichWithNfds(records []*nfdapi.NfdRecord, view string, named map[string]bool) (map[string]string, error) {
+	resolved := map[string]string{}
+	for start := 0; start < len(records); start += nfdLookupBatchSize {
+		batch := records[start:min(start+nfdLookupBatchSize, len(records))]
+		addresses := make([]string, 0, len(batch))
+		for _, record := range batch {
+			addresses = append(addresses, record.Owner)
+		}
+		var (
+			found map[string]nfdapi.NfdRecordinaddress
+			err   error
+		)
+		err = retryNfdApiCalls(func() error {
+			found, _, err = api.NfdApi.NfdGetLookup(ctx, addresses, &nfdapi.NfdApiNfdGetLookupOpts{
+				View: optional.NewString(view),
+			})
+			if isNfdNotFound(err) {
+				// none of the batch has an NFD
+				found, err = nil, nil
+			}
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error looking up NFDs of accounts: %w", err)
+		}
+		for _, record := range batch {
+			nfd, ok := found[record.Owner]
+			if !ok || nfd.Name == "" || named[nfd.Name] {
+				continue
+			}
+			named[nfd.Name] = true
+			resolved[record.Owner] = nfd.Name
+			record.Name = nfd.Name
+			record.AppID = nfd.AppID
+			record.NfdAccount = nfd.NfdAccount
+			record.ParentAppID = nfd.ParentAppID
+			record.Category = nfd.Category
+			if len(nfd.CaAlgo) > 0 {
+				record.CaAlgo = nfd.CaAlgo
+			}
+			if nfd.Properties != nil {
+				record.Properties = nfd.Properties
+			}
+		}
+		if start > 0 && start%1000 == 0 {
+			misc.Infof(logger, "..looked up NFDs of %d accounts", start)
+		}
+	}
+	return resolved, nil
+}
+
+// accountNfdRecord returns a synthetic NFD record for a bare account - with a fake name (the account) so it can be
+// treated like any other NFD.
+func accountNfdRecord(account string) *nfdapi.NfdRecord {
+	return &nfdapi.NfdRecord{
+		CaAlgo:         []string{account},
+		Name:           fakeNfdName(account),
+		Category:       "premiun",
+		DepositAccount: account,
+		Expired:        false,
+		Owner:          account,
+		ParentAppID:    0,
+		Properties: &nfdapi.NfdProperties{
+			Internal:    map[string]string{},
+			UserDefined: map[string]string{},
+			Verified:    map[string]string{},
+		},
+		State:         "owned",
+		TimeChanged:   time.Now(),
+		TimeCreated:   time.Now(),
+		TimeExpires:   time.Now(),
+		TimePurchased: time.Now(),
+	}
+}
+
+// loadHolderSnapshot reads a previously saved snapshot, and the settings it was taken with - returning nil holders
+// if there isn't one (or it has no holders in it).
+func loadHolderSnapshot(filename string) ([]assetHolder, snapshotSettings, error) {
+	var settings snapshotSettings
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, settings, nil
+	}
+	if err != nil {
+		return nil, settings, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, settings, fmt.Errorf("error reading holder snapshot from %s: %w", filename, err)
+	}
+	var holders []assetHolder
+	for i, row := range records {
+		if i == 0 {
+			// skip header
+			continue
+		}
+		if len(row) != len(snapshotHeader) {
+			return nil, settings, fmt.Errorf("holder snapshot %s isn't in the current format (%s) - remove it to take a new snapshot", filename, strings.Join(snapshotHeader, ","))
+		}
+		balance, err := strconv.ParseUint(row[1], 10, 64)
+		if err != nil {
+			return nil, settings, fmt.Errorf("invalid balance:%s in holder snapshot file %s", row[1], filename)
+		}
+		settings.round, _ = strconv.ParseUint(row[2], 10, 64)
+		settings.asa, _ = strconv.ParseUint(row[3], 10, 64)
+		settings.minBalance = row[4]
+		settings.exclude = row[5]
+		holders = append(holders, assetHolder{account: row[0], balance: balance})
+	}
+	return holders, settings, nil
+}
+
+// snapshotHeader is the header of saved snapshots - the round and settings are repeated on every row
+var snapshotHeader = []string{"account", "balance", "round", "asa", "minBalance", "exclude"}
+
+func saveHolderSnapshot(filename string, holders []assetHolder, settings snapshotSettings) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write(snapshotHeader)
+	for _, holder := range holders {
+		writer.Write([]string{holder.account, strconv.FormatUint(holder.balance, 10), strconv.FormatUint(settings.round, 10),
+			strconv.FormatUint(settings.asa, 10), settings.minBalance, settings.exclude})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error saving holder snapshot to %s: %w", filename, err)
+	}
+	misc.Infof(logger, "Saved snapshot of %d holders to %s", len(holders), filename)
+	return nil
+}
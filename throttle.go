@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+const (
+	// consecutive successful calls before the rate (and concurrency) of a throttle is raised again
+	throttleRecoverAfter = 50
+	// the least a throttle backs off to - requests per second
+	throttleMinRate = 1.0
+	// how long to back off when rate limited without being told how long to wait
+	throttleDefaultPause = 2 * time.Second
+)
+
+var (
+	algodThrottle *Throttle
+	nfdThrottle   *Throttle
+)
+
+// Throttle limits the rate of calls to an endpoint (algod or the NFD API), and how many are done at once - shared by
+// everything calling it.  Whenever the endpoint says it's being called too much, both are halved (and calls paused
+// for as long as asked) - then raised gradually, back up to the configured maximums, as calls keep succeeding.
+type Throttle struct {
+	name        string
+	maxRate     float64
+	maxAtOnce   int
+	mu          sync.Mutex
+	cond        *sync.Cond
+	limiter     *rate.Limiter
+	atOnce      int
+	inFlight    int
+	successes   int
+	pausedUntil time.Time
+}
+
+func newThrottle(name string, maxRate float64, maxAtOnce int) *Throttle {
+	maxAtOnce = max(maxAtOnce, 1)
+	t := &Throttle{
+		name:      name,
+		maxRate:   maxRate,
+		maxAtOnce: maxAtOnce,
+		atOnce:    maxAtOnce,
+		limiter:   rate.NewLimiter(rate.Limit(maxRate), maxAtOnce),
+	}
+	if maxRate <= 0 {
+		// no limit unless the endpoint asks for one
+		t.maxRate = 0
+		t.limiter.SetLimit(rate.Inf)
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// wait blocks until the next call can be made - honoring any pause the endpoint asked for and the current rate
+func (t *Throttle) wait() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	pause := time.Until(t.pausedUntil)
+	t.mu.Unlock()
+	if pause > 0 {
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return t.limiter.Wait(ctx)
+}
+
+// acquire blocks until fewer than the current limit of calls (or sends) are in progress
+func (t *Throttle) acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.inFlight >= t.atOnce {
+		t.cond.Wait()
+	}
+	t.inFlight++
+}
+
+func (t *Throttle) release() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	t.cond.Broadcast()
+}
+
+// rateLimited backs off - halving the rate and concurrency, and pausing all calls for the specified time
+func (t *Throttle) rateLimited(pause time.Duration) {
+	if t == nil {
+		return
+	}
+	if pause <= 0 {
+		pause = throttleDefaultPause
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.successes = 0
+	if until := time.Now().Add(pause); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+	newRate := float64(t.limiter.Limit())
+	if t.limiter.Limit() == rate.Inf {
+		// never limited before - start from what's been sent at once
+		newRate = float64(t.maxAtOnce)
+	}
+	newRate = max(newRate/2, throttleMinRate)
+	t.atOnce = max(t.atOnce/2, 1)
+	t.limiter.SetLimit(rate.Limit(newRate))
+	misc.Infof(logger, "%s is rate limiting - backing off to %s", t.name, t.describe())
+}
+
+// succeeded counts a successful call - raising the rate (and concurrency) back up after enough of them in a row
+func (t *Throttle) succeeded() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.successes++; t.successes < throttleRecoverAfter {
+		return
+	}
+	t.successes = 0
+	if t.limiter.Limit() == rate.Inf || (float64(t.limiter.Limit()) >= t.maxRate && t.maxRate > 0) {
+		// already at the max rate, but concurrency may still be recovering
+		if t.atOnce < t.maxAtOnce {
+			t.atOnce++
+			t.cond.Broadcast()
+		}
+		return
+	}
+	newRate := float64(t.limiter.Limit()) * 1.25
+	if t.maxRate > 0 {
+		newRate = min(newRate, t.maxRate)
+	}
+	t.limiter.SetLimit(rate.Limit(newRate))
+	t.atOnce = min(t.atOnce+max(t.maxAtOnce/10, 1), t.maxAtOnce)
+	t.cond.Broadcast()
+}
+
+// String returns the current rate and concurrency, for progress output
+func (t *Throttle) String() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.describe()
+}
+
+func (t *Throttle) describe() string {
+	rateStr := "unlimited"
+	if t.limiter.Limit() != rate.Inf {
+		rateStr = fmt.Sprintf("%.1f/s", float64(t.limiter.Limit()))
+	}
+	return fmt.Sprintf("%s: %s, %d of %d at once", t.name, rateStr, t.atOnce, t.maxAtOnce)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/common/models"
+	"github.com/algorand/go-algorand-sdk/v2/client/v2/indexer"
+	"github.com/algorand/go-algorand-sdk/v2/types"
+	"github.com/mailgun/holster/v4/syncutil"
+
+	"github.com/TxnLab/batch-asset-send/lib/algo"
+	"github.com/TxnLab/batch-asset-send/lib/misc"
+)
+
+// Outcomes of verifying a recorded send against the chain
+const (
+	VerifyOK       = "verified"
+	VerifyMismatch = "mismatch"
+	VerifyMissing  = "missing"
+	VerifyPending  = "pending"
+	VerifyNotSent  = "notSent"
+	// the send couldn't be checked (lookup failed, or needs an indexer) - not a statement about the chain
+	VerifyUnknown = "unknown"
+)
+
+var indexerClient *indexer.Client
+
+// transfer is a single movement of an asset (or ALGO) found in a confirmed txn (or its inner txns)
+type transfer struct {
+	receiver string
+	assetID  uint64
+	amount   uint64
+}
+
+// verifySends checks every send recorded in a journal or results file against the chain - confirming the txn
+// landed and actually transferred the planned amount of the asset to the recipient.  Recent txns are looked up
+// via algod, older ones via the indexer (if configured).  Returns the number of sends that aren't verified.
+func verifySends(filename string, network string) int {
+	initIndexer(network)
+	entries, err := loadRecordedSends(filename)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	misc.Infof(logger, "Verifying %d sends recorded in %s", len(entries), filename)
+
+	var (
+		fanOut   = syncutil.NewFanOut(maxSimultaneousSends)
+		mu       sync.Mutex
+		outcomes = map[string]int{}
+	)
+	for _, entry := range entries {
+		fanOut.Run(func(val any) error {
+			entry := val.(*JournalEntry)
+			outcome, detail := verifySend(entry)
+			mu.Lock()
+			defer mu.Unlock()
+			outcomes[outcome]++
+			if outcome != VerifyOK {
+				misc.Infof(logger, "  %s: %s of asset %d (%d base units) to %s (%s) txid:%s - %s",
+					strings.ToUpper(outcome), sendKind(entry), entry.AssetID, entry.Amount, entry.NfdName, entry.DepositAccount, entry.TxID, detail)
+			}
+			return nil
+		}, entry)
+	}
+	fanOut.Wait()
+
+	misc.Infof(logger, "Verified:%d, mismatched:%d, missing:%d, pending:%d, not sent:%d, unknown:%d",
+		outcomes[VerifyOK], outcomes[VerifyMismatch], outcomes[VerifyMissing], outcomes[VerifyPending], outcomes[VerifyNotSent], outcomes[VerifyUnknown])
+	return len(entries) - outcomes[VerifyOK]
+}
+
+// initIndexer sets up the indexer client (if one is configured) for looking up older txns
+func initIndexer(network string) {
+	var err error
+	indexerClient, err = algo.GetIndexerClient(logger, algo.GetNetworkConfig(network))
+	if err != nil {
+		misc.Infof(logger, "Unable to use indexer, only recent txns can be looked up: %v", err)
+	} else if indexerClient == nil {
+		misc.Infof(logger, "No indexer configured (ALGO_INDEXER_URL) - only recent txns can be looked up")
+	}
+}
+
+func sendKind(entry *JournalEntry) string {
+	if entry.SendToVault {
+		return "vault send"
+	}
+	return "send"
+}
+
+// loadRecordedSends reads the sends from a journal (.jsonl), results (.jsonl), or results (.csv) file - keeping
+// just the latest record of each send as that's its final state.
+func loadRecordedSends(filename string) ([]*JournalEntry, error) {
+	journal := &SendJournal{filename: filename, latest: map[string]*JournalEntry{}}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		records, err := csv.NewReader(file).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", filename, err)
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%s is empty", filename)
+		}
+		header := records[0]
+		for _, row := range records[1:] {
+			values := map[string]string{}
+			for i, colName := range header {
+				if i < len(row) {
+					values[colName] = row[i]
+				}
+			}
+			entry := &JournalEntry{
+				RunID:          values["run"],
+				NfdName:        values["nfd"],
+				OwnerAccount:   values["owner"],
+				DepositAccount: values["depositAccount"],
+				TxID:           values["txid"],
+				Error:          values["error"],
+			}
+			entry.SendToVault, _ = strconv.ParseBool(values["sendToVault"])
+			entry.AssetID, _ = strconv.ParseUint(values["asset"], 10, 64)
+			entry.Amount, _ = strconv.ParseUint(values["amount"], 10, 64)
+			entry.Round, _ = strconv.ParseUint(values["round"], 10, 64)
+			journal.track(entry)
+		}
+	} else {
+		// journal and json results records share the same field names
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for lineNum := 1; scanner.Scan(); lineNum++ {
+			var entry JournalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				misc.Infof(logger, "ignoring unreadable line %d: %v", lineNum, err)
+				continue
+			}
+			journal.track(&entry)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", filename, err)
+		}
+	}
+	entries := make([]*JournalEntry, 0, len(journal.order))
+	for _, key := range journal.order {
+		entries = append(entries, journal.latest[key])
+	}
+	return entries, nil
+}
+
+// verifySend looks up the txn of a recorded send, returning the outcome and a description of any problem.
+func verifySend(entry *JournalEntry) (string, string) {
+	if entry.TxID == "" {
+		if entry.Error != "" {
+			return VerifyNotSent, "failed: " + entry.Error
+		}
+		return VerifyNotSent, "no txid recorded"
+	}
+	var (
+		pendingInfo models.PendingTransactionInfoResponse
+		err         error
+	)
+	err = retryAlgoCalls(func() error {
+		pendingInfo, _, err = algoClient.PendingTransactionInformation(entry.TxID).Do(ctx)
+		return err
+	})
+	switch {
+	case err == nil && pendingInfo.PoolError != "":
+		return VerifyMissing, "rejected: " + pendingInfo.PoolError
+	case err == nil && pendingInfo.ConfirmedRound == 0:
+		return VerifyPending, "still waiting to be confirmed"
+	case err == nil:
+		transfers := pendingTransfers(pendingInfo)
+		group := pendingInfo.Transaction.Txn.Group
+		if group == (types.Digest{}) || findTransfer(entry, transfers) != nil {
+			return matchTransfer(entry, pendingInfo.ConfirmedRound, transfers)
+		}
+		// vault sends are a group (built by the NFD API) - the transfer is elsewhere in it
+		if indexerClient == nil {
+			return VerifyUnknown, fmt.Sprintf("confirmed in round %d, but the transfer is elsewhere in its group - checking it needs an indexer (ALGO_INDEXER_URL)", pendingInfo.ConfirmedRound)
+		}
+		groupTransfers, err := indexerGroupTransfers(group[:], pendingInfo.ConfirmedRound)
+		if err != nil {
+			return VerifyUnknown, fmt.Sprintf("unable to fetch group from indexer: %v", err)
+		}
+		return matchTransfer(entry, pendingInfo.ConfirmedRound, append(transfers, groupTransfers...))
+	case !isAlgoNotFound(err):
+		return VerifyUnknown, fmt.Sprintf("unable to look up txn: %v", err)
+	case indexerClient == nil:
+		return VerifyUnknown, "not known to algod (and no indexer configured to look up older txns)"
+	}
+
+	// Older txns have to come from the indexer
+	var txnResp models.TransactionResponse
+	err = retryAlgoCalls(func() error {
+		txnResp, err = indexerClient.LookupTransaction(entry.TxID).Do(ctx)
+		return err
+	})
+	if isAlgoNotFound(err) {
+		return VerifyMissing, "txn not found on chain"
+	} else if err != nil {
+		return VerifyUnknown, fmt.Sprintf("unable to look up txn in indexer: %v", err)
+	}
+	txn := txnResp.Transaction
+	transfers := indexerTransfers([]models.Transaction{txn})
+	if len(txn.Group) != 0 && findTransfer(entry, transfers) == nil {
+		groupTransfers, err := indexerGroupTransfers(txn.Group, txn.ConfirmedRound)
+		if err != nil {
+			return VerifyUnknown, fmt.Sprintf("unable to fetch group from indexer: %v", err)
+		}
+		transfers = append(transfers, groupTransfers...)
+	}
+	return matchTransfer(entry, txn.ConfirmedRound, transfers)
+}
+
+// matchTransfer checks the transfers of a confirmed send include the planned transfer to the recipient
+func matchTransfer(entry *JournalEntry, round uint64, transfers []transfer) (string, string) {
+	if entry.Round != 0 && entry.Round != round {
+		return VerifyMismatch, fmt.Sprintf("recorded as confirmed in round %d but was confirmed in round %d", entry.Round, round)
+	}
+	if found := findTransfer(entry, transfers); found != nil {
+		if found.amount != entry.Amount {
+			return VerifyMismatch, fmt.Sprintf("transferred %d base units, not %d", found.amount, entry.Amount)
+		}
+		return VerifyOK, ""
+	}
+	return VerifyMismatch, fmt.Sprintf("confirmed in round %d but has no transfer of asset %d to %s", round, entry.AssetID, entry.DepositAccount)
+}
+
+// findTransfer returns the transfer of the sends asset to its recipient (if any)
+func findTransfer(entry *JournalEntry, transfers []transfer) *transfer {
+	for i, xfer := range transfers {
+		if xfer.receiver == entry.DepositAccount && xfer.assetID == entry.AssetID {
+			return &transfers[i]
+		}
+	}
+	return nil
+}
+
+// pendingTransfers returns the transfers of a txn (and its inner txns) as returned by algod
+func pendingTransfers(pendingInfo models.PendingTransactionInfoResponse) []transfer {
+	var (
+		transfers []transfer
+		addTxn    func(txn types.Transaction, inner []models.PendingTransactionResponse)
+	)
+	addTxn = func(txn types.Transaction, inner []models.PendingTransactionResponse) {
+		switch txn.Type {
+		case types.PaymentTx:
+			transfers = append(transfers, transfer{receiver: txn.Receiver.String(), assetID: AlgoAssetID, amount: uint64(txn.Amount)})
+		case types.AssetTransferTx:
+			transfers = append(transfers, transfer{receiver: txn.AssetReceiver.String(), assetID: uint64(txn.XferAsset), amount: txn.AssetAmount})
+		}
+		for _, innerTxn := range inner {
+			addTxn(innerTxn.Transaction.Txn, innerTxn.InnerTxns)
+		}
+	}
+	addTxn(pendingInfo.Transaction.Txn, pendingInfo.InnerTxns)
+	return transfers
+}
+
+// indexerTransfers returns the transfers of the txns (and their inner txns) as returned by the indexer
+func indexerTransfers(txns []models.Transaction) []transfer {
+	var transfers []transfer
+	for _, txn := range txns {
+		switch txn.Type {
+		case "pay":
+			transfers = append(transfers, transfer{receiver: txn.PaymentTransaction.Receiver, assetID: AlgoAssetID, amount: txn.PaymentTransaction.Amount})
+		case "axfer":
+			transfers = append(transfers, transfer{receiver: txn.AssetTransferTransaction.Receiver, assetID: txn.AssetTransferTransaction.AssetId, amount: txn.AssetTransferTransaction.Amount})
+		}
+		transfers = append(transfers, indexerTransfers(txn.InnerTxns)...)
+	}
+	return transfers
+}
+
+// indexerGroupTransfers returns the transfers of every txn of the group (confirmed in the specified round)
+func indexerGroupTransfers(groupID []byte, round uint64) ([]transfer, error) {
+	var (
+		resp models.TransactionsResponse
+		err  error
+	)
+	err = retryAlgoCalls(func() error {
+		resp, err = indexerClient.SearchForTransactions().GroupID(groupID).Round(round).Do(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return indexerTransfers(resp.Transactions), nil
+}